@@ -0,0 +1,70 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Addr is the address of a conn or a Listener of this package. Its network
+// is "io".
+type Addr struct {
+	// Name is the name of the endpoint, if it has one.
+	Name string
+
+	// ID tells the conns of a process apart. It is 0 for a Listener.
+	ID uint64
+}
+
+func (a Addr) Network() string {
+	return "io"
+}
+
+// String returns the address in the form "io:name#id", leaving out the
+// parts that are not set.
+func (a Addr) String() string {
+	s := "io"
+	if a.Name != "" {
+		s += ":" + a.Name
+	}
+	if a.ID != 0 {
+		s += "#" + strconv.FormatUint(a.ID, 10)
+	}
+	return s
+}
+
+// ErrNameInUse is returned by ListenName if another Listener was already
+// published under the name.
+var ErrNameInUse error = errors.New("name already in use")
+
+// registry holds the endpoints published with ListenName.
+var registry = struct {
+	sync.RWMutex
+	endpoints map[string]Opener
+}{endpoints: make(map[string]Opener)}
+
+// ListenName publishes a Listener under name, for example "metrics-plugin".
+// Every Dialer can then connect to it with the address "metrics-plugin" or
+// "io:metrics-plugin", within the same process. Closing the Listener
+// withdraws the name.
+func ListenName(ctx context.Context, name string, opts ...ListenOption) (net.Listener, error) {
+	registry.Lock()
+	if _, ok := registry.endpoints[name]; ok {
+		registry.Unlock()
+		return nil, &net.OpError{Op: "listen", Net: "io", Addr: Addr{Name: name}, Err: ErrNameInUse}
+	}
+	l, e := listenPipe(ctx, name, opts)
+	registry.endpoints[name] = e
+	registry.Unlock()
+
+	l.atClose(func() {
+		registry.Lock()
+		if registry.endpoints[name] == Opener(e) {
+			delete(registry.endpoints, name)
+		}
+		registry.Unlock()
+	})
+	return l, nil
+}
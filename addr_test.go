@@ -0,0 +1,82 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddrString(t *testing.T) {
+	for _, tc := range []struct {
+		addr Addr
+		want string
+	}{
+		{Addr{}, "io"},
+		{Addr{Name: "plugin"}, "io:plugin"},
+		{Addr{ID: 7}, "io#7"},
+		{Addr{Name: "plugin", ID: 7}, "io:plugin#7"},
+	} {
+		if got := tc.addr.String(); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestListenName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	l, err := ListenName(ctx, "metrics-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := l.Addr().String(); got != "io:metrics-plugin" {
+		t.Errorf("unexpected listener address %q", got)
+	}
+	if _, err := ListenName(ctx, "metrics-plugin"); !errors.Is(err, ErrNameInUse) {
+		t.Fatalf("expected ErrNameInUse, got %v", err)
+	}
+
+	var d Dialer
+	ids := make(map[uint64]bool)
+	for _, address := range []string{"metrics-plugin", "io:metrics-plugin"} {
+		c, err := d.DialContext(ctx, "io", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ac, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ac.Close()
+
+		remote := c.RemoteAddr().(Addr)
+		if remote.Name != "metrics-plugin" || !strings.HasPrefix(remote.String(), "io:metrics-plugin#") {
+			t.Errorf("unexpected remote address %v", remote)
+		}
+		if local := ac.LocalAddr().(Addr); local.Name != "metrics-plugin" {
+			t.Errorf("unexpected local address of accepted conn %v", local)
+		}
+		for _, id := range []uint64{remote.ID, ac.LocalAddr().(Addr).ID} {
+			if ids[id] {
+				t.Errorf("conn ID %d used twice", id)
+			}
+			ids[id] = true
+		}
+	}
+
+	// Closing the listener frees the name.
+	l.Close()
+	if _, err := d.DialContext(ctx, "io", "metrics-plugin"); !errors.Is(err, ErrUnknownEndpoint) {
+		t.Fatalf("expected ErrUnknownEndpoint, got %v", err)
+	}
+	l, err = ListenName(ctx, "metrics-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
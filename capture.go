@@ -0,0 +1,449 @@
+package stdl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	blockSectionHeader        = 0x0a0d0d0a
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEnd      = 0
+	optComment  = 1
+	optTSResol  = 9 // in interface description blocks
+	optEPBFlags = 2 // in enhanced packet blocks
+
+	// epbInbound and epbOutbound are the direction bits of epb_flags.
+	epbInbound  = 1
+	epbOutbound = 2
+
+	// linkTypeRaw is LINKTYPE_RAW: packets start with an IP header.
+	linkTypeRaw = 101
+)
+
+// Synthetic addresses of captured conns. The local port is derived from
+// the conn ID, the peer always uses capturePeerPort, so that Wireshark
+// decodes HTTP, and HTTP/2 with its preface, without further setup.
+var (
+	captureLocalIP = [4]byte{127, 0, 0, 1}
+	capturePeerIP  = [4]byte{127, 0, 0, 2}
+)
+
+const (
+	capturePeerPort = 80
+	ipHeaderSize    = 20
+	tcpHeaderSize   = 20
+	// maxSegment keeps synthetic packets within the IPv4 length limit.
+	maxSegment = math.MaxUint16 - ipHeaderSize - tcpHeaderSize
+)
+
+// WithCapture writes the data that conns read and write to w in the pcapng
+// format, which Wireshark can open. Every chunk becomes a TCP segment
+// between synthetic IPv4 endpoints, with its time, its direction and a
+// comment holding the ID of its conn. Given to Listen, all conns the
+// listener accepts are written to w. Every call of WithCapture starts a new
+// capture, so conns that share an option value share a capture.
+//
+// If writing to w fails, the error is logged and capturing stops.
+func WithCapture(w io.Writer) Option {
+	return &optionCapture{cw: &captureWriter{w: w}}
+}
+
+type optionCapture struct {
+	cw *captureWriter
+}
+
+func (opt *optionCapture) apply(c *conn) error {
+	c.capture = opt.cw
+	return nil
+}
+
+func (opt *optionCapture) applyListener(l *listener) {
+	l.capture = opt.cw
+}
+
+// captureWriter writes packets to a pcapng stream.
+type captureWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	started bool
+	err     error
+	buf     []byte
+}
+
+// captureFlow is the TCP state of a captured conn.
+type captureFlow struct {
+	// seq are the next sequence numbers of the local and the peer side.
+	seq [2]uint32
+}
+
+// captureData captures a chunk of data that c has read or written.
+func (c *conn) captureData(inbound bool, b []byte) {
+	if c.capture == nil {
+		return
+	}
+	if err := c.capture.write(c, inbound, b); err != nil {
+		c.errorLogger.Error("failed to capture", "conn", c.cid, "err", err)
+	}
+}
+
+// write writes b as one or more packets of the flow of c. It returns an
+// error only the first time writing fails.
+func (cw *captureWriter) write(c *conn, inbound bool, b []byte) error {
+	now := time.Now()
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return nil
+	}
+	if !cw.started {
+		cw.started = true
+		cw.buf = appendSectionHeader(cw.buf[:0])
+		cw.buf = appendInterfaceDescription(cw.buf)
+		if _, cw.err = cw.w.Write(cw.buf); cw.err != nil {
+			return cw.err
+		}
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxSegment {
+			n = maxSegment
+		}
+		cw.buf = appendPacket(cw.buf[:0], now, c.cid, &c.captureFlow, inbound, b[:n])
+		if _, cw.err = cw.w.Write(cw.buf); cw.err != nil {
+			return cw.err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// appendBlock appends a block of type typ with the given body, padded to
+// 32 bits.
+func appendBlock(dst []byte, typ uint32, body []byte) []byte {
+	pad := -len(body) & 3
+	size := uint32(12 + len(body) + pad)
+	dst = binary.LittleEndian.AppendUint32(dst, typ)
+	dst = binary.LittleEndian.AppendUint32(dst, size)
+	dst = append(dst, body...)
+	dst = append(dst, make([]byte, pad)...)
+	return binary.LittleEndian.AppendUint32(dst, size)
+}
+
+// appendOption appends an option with a value padded to 32 bits.
+func appendOption(dst []byte, code uint16, value []byte) []byte {
+	dst = binary.LittleEndian.AppendUint16(dst, code)
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(value)))
+	dst = append(dst, value...)
+	return append(dst, make([]byte, -len(value)&3)...)
+}
+
+func appendSectionHeader(dst []byte) []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, byteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major version
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor version
+	body = binary.LittleEndian.AppendUint64(body, math.MaxUint64)
+	return appendBlock(dst, blockSectionHeader, body)
+}
+
+func appendInterfaceDescription(dst []byte) []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint16(body, linkTypeRaw)
+	body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+	body = binary.LittleEndian.AppendUint32(body, 0) // no snap length
+	body = appendOption(body, optTSResol, []byte{9}) // nanoseconds
+	body = appendOption(body, optEnd, nil)
+	return appendBlock(dst, blockInterfaceDescription, body)
+}
+
+func appendPacket(dst []byte, t time.Time, cid uint64, f *captureFlow, inbound bool, payload []byte) []byte {
+	srcIP, dstIP := captureLocalIP, capturePeerIP
+	srcPort, dstPort := capturePort(cid), uint16(capturePeerPort)
+	from, to := 0, 1
+	flags := uint32(epbOutbound)
+	if inbound {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		from, to = 1, 0
+		flags = epbInbound
+	}
+
+	pkt := make([]byte, ipHeaderSize+tcpHeaderSize, ipHeaderSize+tcpHeaderSize+len(payload))
+	ip := pkt[:ipHeaderSize]
+	ip[0] = 0x45 // IPv4, 5 words of header
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)+len(payload)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64                                 // TTL
+	ip[9] = 6                                  // TCP
+	copy(ip[12:], srcIP[:])
+	copy(ip[16:], dstIP[:])
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+	tcp := pkt[ipHeaderSize:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], f.seq[from])
+	binary.BigEndian.PutUint32(tcp[8:], f.seq[to])
+	tcp[12] = 5 << 4                             // 5 words of header
+	tcp[13] = 0x18                               // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff) // window
+	pkt = append(pkt, payload...)
+	tcp = pkt[ipHeaderSize:]
+	var pseudo [12]byte
+	copy(pseudo[0:], srcIP[:])
+	copy(pseudo[4:], dstIP[:])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo[:]), tcp))
+	f.seq[from] += uint32(len(payload))
+
+	ts := uint64(t.UnixNano())
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, 0) // interface
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt)))
+	body = append(body, pkt...)
+	body = append(body, make([]byte, -len(pkt)&3)...)
+	body = appendOption(body, optEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	body = appendOption(body, optComment, []byte("conn="+strconv.FormatUint(cid, 10)))
+	body = appendOption(body, optEnd, nil)
+	return appendBlock(dst, blockEnhancedPacket, body)
+}
+
+// capturePort maps a conn ID to an unprivileged port.
+func capturePort(cid uint64) uint16 {
+	return uint16(1024 + cid%(math.MaxUint16-1024))
+}
+
+// sum adds b to the one's complement sum s.
+func sum(s uint32, b []byte) uint32 {
+	for ; len(b) > 1; b = b[2:] {
+		s += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// checksum returns the Internet checksum of b, continuing the sum s.
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// ErrInvalidCapture is returned by a CaptureReader for data that is not a
+// pcapng capture written by WithCapture.
+var ErrInvalidCapture error = errors.New("invalid capture")
+
+// maxBlockSize bounds the blocks that a CaptureReader reads, so that a
+// corrupt length cannot make it allocate without limit. WithCapture writes
+// far smaller blocks.
+const maxBlockSize = 64 << 20
+
+// CaptureFormatError is returned by a CaptureReader for data that is not a
+// pcapng capture written by WithCapture. It wraps ErrInvalidCapture.
+type CaptureFormatError struct {
+	// Reason describes what is wrong with the data.
+	Reason string
+}
+
+func (e *CaptureFormatError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidCapture, e.Reason)
+}
+
+func (e *CaptureFormatError) Unwrap() error {
+	return ErrInvalidCapture
+}
+
+// CapturedPacket is a chunk of data read back from a capture.
+type CapturedPacket struct {
+	Time time.Time
+	// ConnID is the ID of the conn, as in its Addr.
+	ConnID uint64
+	// Inbound is true for data that the conn read, false for data it
+	// wrote.
+	Inbound bool
+	Data    []byte
+}
+
+// CaptureReader reads the packets of a capture written by WithCapture.
+type CaptureReader struct {
+	r      *bufio.Reader
+	order  binary.ByteOrder
+	tsUnit []time.Duration // per interface
+}
+
+// NewCaptureReader returns a CaptureReader reading from r.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next packet. At the end of the capture, it returns
+// io.EOF.
+func (cr *CaptureReader) Next() (CapturedPacket, error) {
+	for {
+		typ, body, err := cr.readBlock()
+		if err != nil {
+			return CapturedPacket{}, err
+		}
+		switch typ {
+		case blockInterfaceDescription:
+			if err := cr.readInterface(body); err != nil {
+				return CapturedPacket{}, err
+			}
+		case blockEnhancedPacket:
+			return cr.readPacket(body)
+		}
+	}
+}
+
+// readBlock reads the next block and returns its type and body.
+func (cr *CaptureReader) readBlock() (uint32, []byte, error) {
+	var head [12]byte
+	if _, err := io.ReadFull(cr.r, head[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = &CaptureFormatError{Reason: "truncated block"}
+		}
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(head[:]) == blockSectionHeader {
+		// The byte order magic follows the length, whose byte order it
+		// tells.
+		if _, err := io.ReadFull(cr.r, head[8:12]); err != nil {
+			return 0, nil, &CaptureFormatError{Reason: "truncated block"}
+		}
+		switch {
+		case binary.LittleEndian.Uint32(head[8:]) == byteOrderMagic:
+			cr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(head[8:]) == byteOrderMagic:
+			cr.order = binary.BigEndian
+		default:
+			return 0, nil, &CaptureFormatError{Reason: "bad byte order magic"}
+		}
+		cr.tsUnit = nil
+	} else if cr.order == nil {
+		return 0, nil, &CaptureFormatError{Reason: "missing section header"}
+	}
+	typ := cr.order.Uint32(head[:])
+	size := cr.order.Uint32(head[4:])
+	if size < 12 || size > maxBlockSize || size%4 != 0 {
+		return 0, nil, &CaptureFormatError{Reason: fmt.Sprintf("bad block length %d", size)}
+	}
+	rest := make([]byte, size-8)
+	n := 0
+	if typ == blockSectionHeader {
+		n = copy(rest, head[8:12])
+	}
+	if _, err := io.ReadFull(cr.r, rest[n:]); err != nil {
+		return 0, nil, &CaptureFormatError{Reason: "truncated block"}
+	}
+	if cr.order.Uint32(rest[len(rest)-4:]) != size {
+		return 0, nil, &CaptureFormatError{Reason: "block lengths differ"}
+	}
+	return typ, rest[:len(rest)-4], nil
+}
+
+// options calls f for every option in b.
+func (cr *CaptureReader) options(b []byte, f func(code uint16, value []byte)) error {
+	for len(b) >= 4 {
+		code, n := cr.order.Uint16(b), int(cr.order.Uint16(b[2:]))
+		if code == optEnd {
+			return nil
+		}
+		padded := n + -n&3
+		if len(b) < 4+padded {
+			return &CaptureFormatError{Reason: "truncated option"}
+		}
+		f(code, b[4:4+n])
+		b = b[4+padded:]
+	}
+	return nil
+}
+
+func (cr *CaptureReader) readInterface(b []byte) error {
+	if len(b) < 8 {
+		return &CaptureFormatError{Reason: "short interface description"}
+	}
+	if lt := cr.order.Uint16(b); lt != linkTypeRaw {
+		return &CaptureFormatError{Reason: fmt.Sprintf("unsupported link type %d", lt)}
+	}
+	unit := time.Microsecond
+	err := cr.options(b[8:], func(code uint16, value []byte) {
+		if code != optTSResol || len(value) != 1 || value[0]&0x80 != 0 {
+			return
+		}
+		unit = time.Second
+		for i := byte(0); i < value[0] && unit > 1; i++ {
+			unit /= 10
+		}
+	})
+	cr.tsUnit = append(cr.tsUnit, unit)
+	return err
+}
+
+func (cr *CaptureReader) readPacket(b []byte) (CapturedPacket, error) {
+	var p CapturedPacket
+	if len(b) < 20 {
+		return p, &CaptureFormatError{Reason: "short packet block"}
+	}
+	iface := cr.order.Uint32(b)
+	if int(iface) >= len(cr.tsUnit) {
+		return p, &CaptureFormatError{Reason: fmt.Sprintf("unknown interface %d", iface)}
+	}
+	ts := uint64(cr.order.Uint32(b[4:]))<<32 | uint64(cr.order.Uint32(b[8:]))
+	p.Time = time.Unix(0, 0).Add(time.Duration(ts) * cr.tsUnit[iface])
+	n := int(cr.order.Uint32(b[12:]))
+	padded := n + -n&3
+	if len(b) < 20+padded {
+		return p, &CaptureFormatError{Reason: "truncated packet"}
+	}
+	pkt := b[20 : 20+n]
+	if len(pkt) < ipHeaderSize+tcpHeaderSize || pkt[0]>>4 != 4 || pkt[9] != 6 {
+		return p, &CaptureFormatError{Reason: "not a TCP/IPv4 packet"}
+	}
+	ipLen := int(pkt[0]&0xf) * 4
+	if len(pkt) < ipLen+tcpHeaderSize {
+		return p, &CaptureFormatError{Reason: "truncated TCP header"}
+	}
+	tcpLen := int(pkt[ipLen+12]>>4) * 4
+	if len(pkt) < ipLen+tcpLen {
+		return p, &CaptureFormatError{Reason: "truncated TCP header"}
+	}
+	p.Data = pkt[ipLen+tcpLen:]
+	p.Inbound = binary.BigEndian.Uint16(pkt[ipLen:]) == capturePeerPort
+
+	err := cr.options(b[20+padded:], func(code uint16, value []byte) {
+		switch code {
+		case optEPBFlags:
+			if len(value) == 4 {
+				p.Inbound = cr.order.Uint32(value)&3 == epbInbound
+			}
+		case optComment:
+			if id, ok := strings.CutPrefix(string(value), "conn="); ok {
+				p.ConnID, _ = strconv.ParseUint(id, 10, 64)
+			}
+		}
+	})
+	return p, err
+}
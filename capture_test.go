@@ -0,0 +1,144 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var dialed, accepted bytes.Buffer
+	p, q := PipePair()
+	l := Listen(ctx, p, WithCapture(&accepted))
+	defer l.Close()
+	c, err := Dial(ctx, q, WithCapture(&dialed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(s, "pong!"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		capture *bytes.Buffer
+		conn    *conn
+		want    []CapturedPacket
+	}{
+		{&dialed, c.(*conn), []CapturedPacket{{Data: []byte("ping")}, {Inbound: true, Data: []byte("pong!")}}},
+		{&accepted, s.(*conn), []CapturedPacket{{Inbound: true, Data: []byte("ping")}, {Data: []byte("pong!")}}},
+	} {
+		cr := NewCaptureReader(bytes.NewReader(tc.capture.Bytes()))
+		for i, want := range tc.want {
+			got, err := cr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ConnID != tc.conn.cid || got.Inbound != want.Inbound || string(got.Data) != string(want.Data) {
+				t.Errorf("packet %d: expected conn %d, inbound %t, %q, got %+v", i, tc.conn.cid, want.Inbound, want.Data, got)
+			}
+			if time.Since(got.Time) > time.Minute || got.Time.After(time.Now()) {
+				t.Errorf("packet %d: unexpected time %s", i, got.Time)
+			}
+		}
+		if _, err := cr.Next(); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestCapturePacket(t *testing.T) {
+	var f captureFlow
+	payload := []byte("hello")
+	appendPacket(nil, time.Now(), 7, &f, false, payload)
+	b := appendPacket(nil, time.Now(), 7, &f, true, []byte("x"))
+
+	// Skip the block header and the fields of the packet block to check
+	// the synthetic headers.
+	pkt := b[8+20:]
+	pkt = pkt[:binary.LittleEndian.Uint32(b[8+12:])]
+	if checksum(0, pkt[:ipHeaderSize]) != 0 {
+		t.Error("bad IP checksum")
+	}
+	var pseudo [12]byte
+	copy(pseudo[0:], pkt[12:20])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(pkt)-ipHeaderSize))
+	if checksum(sum(0, pseudo[:]), pkt[ipHeaderSize:]) != 0 {
+		t.Error("bad TCP checksum")
+	}
+	tcp := pkt[ipHeaderSize:]
+	if src := binary.BigEndian.Uint16(tcp); src != capturePeerPort {
+		t.Errorf("inbound packet from port %d", src)
+	}
+	if ack := binary.BigEndian.Uint32(tcp[8:]); ack != uint32(len(payload)) {
+		t.Errorf("expected ack %d, got %d", len(payload), ack)
+	}
+}
+
+func TestCaptureReaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"not a capture at all",
+		"\x0a\x0d\x0d\x0a\x1c\x00\x00\x00\x00\x00\x00\x00",
+		// Block lengths too small and too large to be read.
+		"\x0a\x0d\x0d\x0a\x04\x00\x00\x00\x4d\x3c\x2b\x1a",
+		"\x0a\x0d\x0d\x0a\xfc\xff\xff\xff\x4d\x3c\x2b\x1a",
+	} {
+		_, err := NewCaptureReader(strings.NewReader(data)).Next()
+		var fe *CaptureFormatError
+		if !errors.Is(err, ErrInvalidCapture) || !errors.As(err, &fe) {
+			t.Errorf("%q: expected a *CaptureFormatError, got %v", data, err)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestCaptureWriteError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var logs strings.Builder
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	go echo(l)
+	c, err := Dial(ctx, q, WithCapture(failingWriter{}), WithErrorLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := io.WriteString(c, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Count(logs.String(), "failed to capture"); got != 1 {
+		t.Fatalf("expected the error to be logged once, got %q", logs.String())
+	}
+}
@@ -0,0 +1,209 @@
+package stdl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// In checksum mode, every frame is sent as a record
+//
+//	magic(2) seq(4) header(10) crc(4) payload crc(4)
+//
+// where seq counts the records sent over the transport, the first crc
+// covers seq and header, and the second one the payload. The second crc is
+// left out if there is no payload. Both are CRC-32C, in big endian like
+// all other integers.
+const (
+	recordHeaderSize = 2 + 4 + headerSize + 4
+	maxRecordSize    = recordHeaderSize + maxFramePayload + 4
+)
+
+// recordMagic starts every record, so that a reader can find the next one
+// after corrupted bytes.
+var recordMagic = [2]byte{0xd1, 0x5c}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumPolicy tells what a session in checksum mode does when it reads
+// a corrupted frame.
+type ChecksumPolicy int
+
+const (
+	// ChecksumFail ends the session with a *ChecksumError, which pending
+	// and future calls on its conns return.
+	ChecksumFail ChecksumPolicy = iota
+	// ChecksumResync skips bytes up to the next intact frame and keeps the
+	// session running. The conns that lost data to the corruption fail with
+	// a *ChecksumError, and are reset for the peer.
+	ChecksumResync
+)
+
+// ErrChecksum is wrapped by the errors of corrupted frames.
+var ErrChecksum error = errors.New("checksum mismatch")
+
+// ChecksumError describes a corrupted frame. It wraps ErrChecksum.
+type ChecksumError struct {
+	// Stream is the stream of a frame whose payload was corrupted, and 0
+	// if the header was corrupted as well.
+	Stream uint32
+	// Skipped is the number of bytes skipped to find the next frame.
+	Skipped int
+	// Lost is the number of frames that went missing, as told by the
+	// sequence numbers of the frames around them.
+	Lost uint32
+}
+
+func (e *ChecksumError) Error() string {
+	switch {
+	case e.Stream != 0:
+		return fmt.Sprintf("%s: corrupted payload on stream %d", ErrChecksum, e.Stream)
+	case e.Lost != 0:
+		return fmt.Sprintf("%s: lost %d frames, skipped %d bytes", ErrChecksum, e.Lost, e.Skipped)
+	}
+	return fmt.Sprintf("%s: corrupted frame header", ErrChecksum)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksum
+}
+
+// WithChecksums makes the session that Dial or Listen starts over their
+// transport protect every frame with a CRC-32C and a sequence number, for
+// transports such as serial lines that may corrupt or inject bytes. policy
+// tells what happens to a corrupted frame.
+//
+// Both ends must enable checksums. With WithHandshake, they announce
+// FeatureChecksums, and the handshake fails if only one of them does. The
+// option has no effect if a session already runs over the transport.
+func WithChecksums(policy ChecksumPolicy) Option {
+	return optionChecksums{policy}
+}
+
+type optionChecksums struct {
+	policy ChecksumPolicy
+}
+
+func (optionChecksums) apply(*conn) error {
+	return nil
+}
+
+func (optionChecksums) applyListener(*listener) {}
+
+func (opt optionChecksums) applySession(cfg *sessionConfig) {
+	cfg.checksums = true
+	cfg.checksumPolicy = opt.policy
+}
+
+// appendRecord appends the encoded frame f as a record with the sequence
+// number seq.
+func appendRecord(b []byte, seq uint32, f []byte) []byte {
+	b = append(b, recordMagic[:]...)
+	start := len(b)
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = append(b, f[:headerSize]...)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b[start:], castagnoli))
+	if payload := f[headerSize:]; len(payload) > 0 {
+		b = append(b, payload...)
+		b = binary.BigEndian.AppendUint32(b, crc32.Checksum(payload, castagnoli))
+	}
+	return b
+}
+
+// readRecord reads the next frame in checksum mode, and returns it with
+// the sequence number of its record. A corrupted frame yields a
+// *ChecksumError. With ChecksumResync, the next call goes on with the next
+// intact frame. In reliable mode, the caller checks the sequence numbers.
+func (s *session) readRecord(r *bufio.Reader) (h header, payload []byte, seq uint32, err error) {
+	skipped := 0
+	for {
+		b, err := r.Peek(recordHeaderSize)
+		if err != nil {
+			if err == io.EOF && len(b)+skipped > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return h, nil, 0, err
+		}
+		if b[0] != recordMagic[0] || b[1] != recordMagic[1] || crc32.Checksum(b[2:recordHeaderSize-4], castagnoli) != binary.BigEndian.Uint32(b[recordHeaderSize-4:]) {
+			if s.checksumPolicy != ChecksumResync {
+				return h, nil, 0, &ChecksumError{}
+			}
+			r.Discard(1)
+			skipped++
+			continue
+		}
+		h.decode(b[6:])
+		if !h.valid() {
+			// The peer sent it like that.
+			return h, nil, 0, ErrProtocol
+		}
+		seq = binary.BigEndian.Uint32(b[2:])
+		switch {
+		case s.reliable:
+			if skipped > 0 {
+				s.eventLogger.Debug("skipped bytes between frames", "bytes", skipped)
+			}
+		case seq != s.recvSeq || skipped > 0:
+			lost := seq - s.recvSeq
+			s.recvSeq = seq
+			if lost != 0 || s.checksumPolicy != ChecksumResync {
+				// The record is read by the next call.
+				return h, nil, 0, &ChecksumError{Skipped: skipped, Lost: lost}
+			}
+			s.eventLogger.Warn("skipped bytes between frames", "bytes", skipped)
+			fallthrough
+		default:
+			s.recvSeq++
+		}
+		r.Discard(recordHeaderSize)
+		if h.length == 0 {
+			return h, nil, seq, nil
+		}
+
+		b = make([]byte, h.length+4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return h, nil, 0, err
+		}
+		payload = b[:h.length]
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(b[h.length:]) {
+			return h, nil, 0, &ChecksumError{Stream: h.stream}
+		}
+		return h, payload, seq, nil
+	}
+}
+
+// recover resets the streams that may have lost data to the corruption
+// described by err, so that they fail instead of returning wrong data.
+func (s *session) recover(err *ChecksumError) {
+	s.eventLogger.Warn("corrupted frame", "err", err)
+	var ids []uint32
+	var lost []*conn
+	s.mu.Lock()
+	switch {
+	case err.Stream != 0:
+		// The stream may also be one that the peer just opened.
+		ids = append(ids, err.Stream)
+		if c, ok := s.streams[err.Stream]; ok {
+			lost = append(lost, c)
+		}
+	case err.Lost != 0:
+		for id, c := range s.streams {
+			ids = append(ids, id)
+			lost = append(lost, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.control(header{typ: frameReset, stream: id})
+	}
+	for _, c := range lost {
+		s.remove(c.id)
+		c.setReset(err)
+	}
+}
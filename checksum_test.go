@@ -0,0 +1,162 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// corrupter is a transport that hands the next record of a data frame
+// written to it to a function, which may change it.
+type corrupter struct {
+	io.ReadWriter
+	mu sync.Mutex
+	f  func([]byte) []byte
+}
+
+func (c *corrupter) corruptNext(f func([]byte) []byte) {
+	c.mu.Lock()
+	c.f = f
+	c.mu.Unlock()
+}
+
+func (c *corrupter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	f := c.f
+	if f != nil && frameType(b[6]) == frameData {
+		c.f = nil
+	} else {
+		f = nil
+	}
+	c.mu.Unlock()
+	if f == nil {
+		return c.ReadWriter.Write(b)
+	}
+	_, err := c.ReadWriter.Write(f(append([]byte(nil), b...)))
+	return len(b), err
+}
+
+func TestChecksums(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, WithChecksums(ChecksumFail), WithHandshake())
+	defer l.Close()
+	go echo(l)
+	c, err := Dial(ctx, q, WithChecksums(ChecksumFail), WithHandshake())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+	if f := c.(*conn).s.features; f != FeatureMux|FeatureChecksums {
+		t.Fatalf("expected features %s, got %s", FeatureMux|FeatureChecksums, f)
+	}
+}
+
+func TestChecksumsFail(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	cq := &corrupter{ReadWriter: q}
+	l := Listen(ctx, p, WithChecksums(ChecksumFail))
+	defer l.Close()
+	c, err := Dial(ctx, cq, WithChecksums(ChecksumFail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The last byte of the payload flips.
+	cq.corruptNext(func(b []byte) []byte {
+		b[len(b)-5] ^= 1
+		return b
+	})
+	c.Write([]byte("hello"))
+	_, err = s.Read(make([]byte, 5))
+	var ce *ChecksumError
+	if !errors.As(err, &ce) || ce.Stream != c.(*conn).id {
+		t.Fatalf("expected a *ChecksumError for stream %d, got %v", c.(*conn).id, err)
+	}
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected %v to wrap ErrChecksum", err)
+	}
+}
+
+func TestChecksumsResync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	cq := &corrupter{ReadWriter: q}
+	l := Listen(ctx, p, WithChecksums(ChecksumResync))
+	defer l.Close()
+	go echo(l)
+	dial := func() net.Conn {
+		t.Helper()
+		c, err := Dial(ctx, cq, WithChecksums(ChecksumResync))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	a, b := dial(), dial()
+
+	// Bytes injected between frames are skipped.
+	cq.corruptNext(func(b []byte) []byte {
+		return append([]byte("\xd1\x5cjunk"), b...)
+	})
+	testEcho(t, a)
+	testEcho(t, b)
+
+	// A corrupted payload fails its stream only.
+	cq.corruptNext(func(b []byte) []byte {
+		b[len(b)-5] ^= 1
+		return b
+	})
+	a.Write([]byte("hello"))
+	if _, err := a.Read(make([]byte, 5)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+	testEcho(t, b)
+
+	// After a corrupted header, it is not known which stream lost data, so
+	// all of them fail. New streams work.
+	cq.corruptNext(func(b []byte) []byte {
+		b[8] ^= 1
+		return b
+	})
+	b.Write([]byte("hello"))
+	c := dial()
+	if _, err := b.Read(make([]byte, 5)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+	testEcho(t, c)
+}
+
+func TestChecksumErrorString(t *testing.T) {
+	for _, tc := range []struct {
+		err  *ChecksumError
+		want string
+	}{
+		{&ChecksumError{Stream: 3}, "checksum mismatch: corrupted payload on stream 3"},
+		{&ChecksumError{Skipped: 40, Lost: 2}, "checksum mismatch: lost 2 frames, skipped 40 bytes"},
+		{&ChecksumError{}, "checksum mismatch: corrupted frame header"},
+	} {
+		if got := tc.err.Error(); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
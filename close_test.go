@@ -0,0 +1,120 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseRemoteEOF(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, s := connPair(t, ctx)
+
+	data := []byte("bye")
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer reads the data written before Close, followed by io.EOF.
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestCloseLocal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, _ := connPair(t, ctx)
+
+	// A pending Read is released by Close.
+	res := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		res <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-res; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v from pending Read, got %v", net.ErrClosed, err)
+	}
+
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v from Read, got %v", net.ErrClosed, err)
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v from Write, got %v", net.ErrClosed, err)
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v from second Close, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, s := connPair(t, ctx)
+
+	// The server reads the whole request and then answers on the same conn.
+	go func() {
+		req, err := io.ReadAll(s)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s.Write(append([]byte("re: "), req...))
+		s.Close()
+	}()
+
+	if _, err := c.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v after CloseWrite, got %v", net.ErrClosed, err)
+	}
+	resp, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "re: request" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, s := connPair(t, ctx)
+
+	if _, err := s.Write([]byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(interface{ CloseRead() error }).CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF after CloseRead, got %v", err)
+	}
+	// Writing is still possible.
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,162 +1,371 @@
 package stdl
 
 import (
+	"bytes"
 	"context"
-	"encoding/hex"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type input struct {
-	io.ReadWriteCloser
-	r io.Reader
-	w io.WriteCloser
-
-	c *conn
-}
-
-func newInput(c *conn, r io.Reader) *input {
-	p := new(input)
-	p.r, p.w = io.Pipe()
-	p.c = c
-	if r != nil {
-		go func() {
-			for {
-				if _, err := io.Copy(p.w, r); err != nil {
-					p.c.errorLogger.Print(err)
-					return
-				}
-			}
-		}()
-	}
-	return p
-}
-
-func (p *input) Read(b []byte) (int, error) {
-	n, err := p.r.Read(b)
-	if err != nil {
-		p.c.errorLogger.Print(err)
-	}
-	if n > 0 {
-		p.c.eventLogger.Printf("read %db:\n%s", n, hex.Dump(b[:n]))
-	}
-	return n, err
-}
-
-func (p *input) Write(b []byte) (int, error) {
-	n, err := p.w.Write(b)
-	if err != nil {
-		p.c.errorLogger.Print(err)
-	}
-	if n > 0 {
-		p.c.eventLogger.Printf("receive %db:\n%s", n, hex.Dump(b[:n]))
-	}
-	return n, err
-}
+var (
+	_ net.Conn = (*conn)(nil)
+	_ Opener   = (*conn)(nil)
+)
 
-func (p *input) Close() error {
-	return nil
-}
+// connIDs hands out the IDs that tell conns apart in their addresses.
+var connIDs atomic.Uint64
 
+// conn is a single stream of a session.
 type conn struct {
-	net.Conn
 	ctx context.Context
-	in  io.ReadWriter
-	out io.Writer
+	s   *session
+	id  uint32
+	cid uint64
+
+	localName  string
+	remoteName string
+
+	mu           sync.Mutex
+	buf          bytes.Buffer
+	reset        bool
+	resetErr     error
+	readClosed   bool
+	writeClosed  bool
+	remoteClosed bool
+	readable     chan struct{}
+
+	// window is the receive window. recvCredit is how much the peer may
+	// still send, and unacked how much has been read without granting the
+	// peer new credit. sendCredit is how much c may still send, and
+	// writable is notified when it grows.
+	window     int
+	recvCredit int
+	unacked    int
+	sendCredit int
+	writable   chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	eventLogger *slog.Logger
+	errorLogger *slog.Logger
+	dump        dumpConfig
+	reads       atomic.Uint64
+	writes      atomic.Uint64
 
-	eventLogger *log.Logger
-	errorLogger *log.Logger
+	metrics connMetrics
+	// listenerMetrics are the totals of the listener that accepted the
+	// conn, if any.
+	listenerMetrics *connMetrics
+	untracked       atomic.Bool
+
+	capture     *captureWriter
+	captureFlow captureFlow // guarded by capture.mu
 }
 
-func newConn(ctx context.Context, p io.ReadWriter) (c *conn, err error) {
-	c = new(conn)
+func newConn(ctx context.Context, s *session, id uint32) *conn {
+	c := new(conn)
 	c.ctx = ctx
-	c.in = p //newInput(c, p)
-	c.out = p
-	if err != nil {
+	c.s = s
+	c.id = id
+	c.cid = connIDs.Add(1)
+	c.readable = make(chan struct{}, 1)
+	c.writable = make(chan struct{}, 1)
+	c.window = defaultWindowSize
+	c.recvCredit = initialWindow
+	c.sendCredit = initialWindow
+	c.closed = make(chan struct{})
+	c.readDeadline = newDeadline()
+	c.writeDeadline = newDeadline()
+
+	c.eventLogger = defaultLogger
+	c.errorLogger = defaultLogger
+	c.dump = defaultDumpConfig
+	activeConns.Add(1)
+
+	return c
+}
+
+// receive buffers payload that arrived for this stream and wakes up a
+// pending Read. Payload for a stream that no longer reads is discarded,
+// and the peer gets its credit back. A peer that sends more than its
+// credit gets the stream reset.
+func (c *conn) receive(b []byte) {
+	c.mu.Lock()
+	if len(b) > c.recvCredit {
+		c.mu.Unlock()
+		c.s.eventLogger.Warn("peer exceeded the window, resetting stream", "stream", c.id, "bytes", len(b))
+		c.s.control(header{typ: frameReset, stream: c.id})
+		c.s.remove(c.id)
+		c.setReset(ErrConnReset)
+		return
+	}
+	if c.readClosed {
+		c.mu.Unlock()
+		c.grant(len(b))
 		return
 	}
+	c.recvCredit -= len(b)
+	c.buf.Write(b)
+	c.mu.Unlock()
+	c.notify()
+}
 
-	c.eventLogger = eventLogger
-	c.errorLogger = eventLogger
+// setRemoteClosed marks the end of the data sent by the peer.
+func (c *conn) setRemoteClosed() {
+	c.mu.Lock()
+	c.remoteClosed = true
+	done := c.writeClosed
+	c.mu.Unlock()
+	if done {
+		c.s.remove(c.id)
+	}
+	c.notify()
+}
 
-	return
+// setReset marks the stream as reset, after which Read and Write fail
+// with err.
+func (c *conn) setReset(err error) {
+	c.mu.Lock()
+	c.reset = true
+	c.resetErr = err
+	c.mu.Unlock()
+	c.notify()
+	c.wakeWriter()
 }
 
-func (c *conn) Read(b []byte) (n int, err error) {
-	ch := make(chan error)
-	go func() {
-		n, err = c.in.Read(b)
-		ch <- err
-	}()
+func (c *conn) notify() {
 	select {
-	case <-c.ctx.Done():
-		err = ErrContextCanceled
-		return
-	case err = <-ch:
+	case c.readable <- struct{}{}:
+	default:
 	}
-	return
 }
 
-func (c *conn) Write(b []byte) (t int, err error) {
-	ch := make(chan error)
+func (c *conn) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.read(b)
+	c.record(true, n, time.Since(start), err)
+	return n, err
+}
+
+func (c *conn) read(b []byte) (n int, err error) {
+	if isClosed(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if isClosed(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	for {
+		c.mu.Lock()
+		if c.buf.Len() > 0 {
+			n, _ = c.buf.Read(b)
+			inc := c.consumed(n)
+			c.mu.Unlock()
+			c.grant(inc)
+			c.logData("read", c.reads.Add(1), b[:n])
+			c.captureData(true, b[:n])
+			return
+		}
+		switch {
+		case c.readClosed, c.remoteClosed:
+			err = io.EOF
+		case c.reset:
+			err = c.resetErr
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
 
-	go func() {
-		for t < len(b) {
-			n, err := c.out.Write(b[t:])
-			c.eventLogger.Printf("wrote %db:\n%s", n, hex.Dump(b[t:t+n]))
-			t += n
-			if err != nil {
-				ch <- err
-				break
+		select {
+		case <-c.closed:
+			err = net.ErrClosed
+			return
+		case <-c.ctx.Done():
+			err = ErrContextCanceled
+			return
+		case <-c.readDeadline.wait():
+			err = os.ErrDeadlineExceeded
+			return
+		case <-c.s.done:
+			// Hand out whatever arrived before the session ended.
+			c.mu.Lock()
+			pending := c.buf.Len()
+			c.mu.Unlock()
+			if pending == 0 {
+				err = c.s.err
+				c.errorLogger.Error("session ended", "conn", c.cid, "err", err)
+				return
 			}
+		case <-c.readable:
 		}
-		ch <- nil
-	}()
+	}
+}
 
-	select {
-	case <-c.ctx.Done():
+func (c *conn) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.write(b)
+	c.record(false, n, time.Since(start), err)
+	return n, err
+}
+
+func (c *conn) write(b []byte) (t int, err error) {
+	if isClosed(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	for t < len(b) {
+		n := len(b) - t
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		if n, err = c.takeCredit(n); err != nil {
+			break
+		}
+		var sent bool
+		sent, err = c.s.write(c.ctx, c.writeDeadline.wait(), c.closed, header{typ: frameData, stream: c.id}, b[t:t+n])
+		if !sent {
+			// The data never reaches the peer, so its credit is unused.
+			c.addCredit(n)
+			break
+		}
+		c.logData("write", c.writes.Add(1), b[t:t+n])
+		c.captureData(false, b[t:t+n])
+		t += n
+		if err != nil {
+			break
+		}
+	}
+	if err == ErrContextCanceled {
 		if ctxCause := context.Cause(c.ctx); ctxCause != nil {
 			err = ctxCause
-			return
 		}
-		err = ErrContextCanceled
-		return
-	case err = <-ch:
 	}
 	return t, err
 }
 
-func (c *conn) Close() error {
-	//defer c.in.Close()
-	dc, ok := c.ctx.Value("disconnect").(func(context.Context))
-	if ok {
-		go dc(c.ctx)
+// Open opens another stream over the io.ReadWriter of c.
+func (c *conn) Open(ctx context.Context, opts ...DialOption) (net.Conn, error) {
+	nc, err := openConn(ctx, c.s, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
+
+// abort resets a stream that was never handed out.
+func (c *conn) abort() {
+	c.s.control(header{typ: frameReset, stream: c.id})
+	c.s.remove(c.id)
+	c.untrack()
+	if dc, ok := c.ctx.Value("disconnect").(func(context.Context)); ok {
+		dc(c.ctx)
+	}
+}
+
+// CloseWrite shuts down the writing side of the conn. The peer reads
+// io.EOF once it has consumed the data written so far, but may keep
+// sending data of its own.
+func (c *conn) CloseWrite() error {
+	c.mu.Lock()
+	if c.writeClosed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.writeClosed = true
+	done := c.remoteClosed || c.reset
+	c.mu.Unlock()
+
+	_, err := c.s.write(c.ctx, c.writeDeadline.wait(), nil, header{typ: frameClose, stream: c.id}, nil)
+	if done {
+		c.s.remove(c.id)
+	}
+	return err
+}
+
+// CloseRead shuts down the reading side of the conn. Buffered and future
+// data from the peer is discarded and Read returns io.EOF.
+func (c *conn) CloseRead() error {
+	c.mu.Lock()
+	if c.readClosed {
+		c.mu.Unlock()
+		return net.ErrClosed
 	}
+	c.readClosed = true
+	inc := c.discard()
+	c.mu.Unlock()
+	c.notify()
+	c.grant(inc)
 	return nil
 }
 
-func (c *conn) setEventLogger(l *log.Logger) {
-	c.eventLogger = l
+// Close closes both directions of the conn. The peer's Read returns io.EOF,
+// while local Read and Write calls fail with net.ErrClosed.
+func (c *conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+		c.untrack()
+
+		c.mu.Lock()
+		c.readClosed = true
+		inc := c.discard()
+		fin := !c.writeClosed && !c.reset
+		c.writeClosed = true
+		done := c.remoteClosed || c.reset
+		c.mu.Unlock()
+
+		c.grant(inc)
+		if fin {
+			c.s.control(header{typ: frameClose, stream: c.id})
+		}
+		if done {
+			c.s.remove(c.id)
+		}
+
+		dc, ok := c.ctx.Value("disconnect").(func(context.Context))
+		if ok {
+			go dc(c.ctx)
+		}
+	})
+	return err
 }
 
-func (c *conn) setErrorLogger(l *log.Logger) {
-	c.errorLogger = l
+// SetDeadline sets both the read and the write deadline. Blocked and
+// future calls fail with os.ErrDeadlineExceeded once it has passed. Data
+// that arrives after a Read timed out is kept for the next Read.
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
 }
 
-func (c *conn) RemoteAddr() net.Addr {
-	return c
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
 }
 
-func (c *conn) LocalAddr() net.Addr {
-	return c
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
 }
 
-func (c *conn) Network() string {
-	return "io"
+// LocalAddr returns the address of this end of the conn. On the accepting
+// side, it has the name of the listener.
+func (c *conn) LocalAddr() net.Addr {
+	return Addr{Name: c.localName, ID: c.cid}
 }
 
-func (c *conn) String() string {
-	return "io"
+// RemoteAddr returns the address of the peer. On the dialing side, it has
+// the name that the conn was dialed with.
+func (c *conn) RemoteAddr() net.Addr {
+	return Addr{Name: c.remoteName, ID: c.cid}
 }
@@ -0,0 +1,84 @@
+package stdl
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// controlQueue holds the control frames that the reader goroutine and
+// Close produce for the writer goroutine. Queuing them never blocks, as
+// the writer may wait for the peer to read while the peer's writer waits
+// for this end to read. Pings and pongs are sent once however often they
+// are queued, and window updates are added up per stream, so the queue
+// stays small.
+type controlQueue struct {
+	mu      sync.Mutex
+	frames  []header
+	ping    bool
+	pong    bool
+	windows map[uint32]uint32
+	// order holds the streams in windows, in the order of their first
+	// update.
+	order []uint32
+	// ready is notified when a frame is queued.
+	ready chan struct{}
+}
+
+func newControlQueue() *controlQueue {
+	return &controlQueue{windows: make(map[uint32]uint32), ready: make(chan struct{}, 1)}
+}
+
+// add queues a control frame without a payload.
+func (q *controlQueue) add(h header) {
+	q.mu.Lock()
+	switch h.typ {
+	case framePing:
+		q.ping = true
+	case framePong:
+		q.pong = true
+	default:
+		q.frames = append(q.frames, h)
+	}
+	q.mu.Unlock()
+	signal(q.ready)
+}
+
+// addWindow queues a window update that grants the peer n more bytes on
+// the stream id.
+func (q *controlQueue) addWindow(id uint32, n int) {
+	q.mu.Lock()
+	if _, ok := q.windows[id]; !ok {
+		q.order = append(q.order, id)
+	}
+	q.windows[id] += uint32(n)
+	q.mu.Unlock()
+	signal(q.ready)
+}
+
+// take removes the queued frames and returns them encoded, window updates
+// first, so that the peer can go on sending as soon as possible.
+func (q *controlQueue) take() []*frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var frames []*frame
+	for _, id := range q.order {
+		var inc [4]byte
+		binary.BigEndian.PutUint32(inc[:], q.windows[id])
+		frames = append(frames, &frame{b: appendFrame(nil, header{typ: frameWindow, stream: id}, inc[:])})
+		delete(q.windows, id)
+	}
+	q.order = q.order[:0]
+	if q.pong {
+		frames = append(frames, &frame{b: appendFrame(nil, header{typ: framePong}, nil)})
+		q.pong = false
+	}
+	if q.ping {
+		frames = append(frames, &frame{b: appendFrame(nil, header{typ: framePing}, nil)})
+		q.ping = false
+	}
+	for _, h := range q.frames {
+		frames = append(frames, &frame{b: appendFrame(nil, h, nil)})
+	}
+	q.frames = q.frames[:0]
+	return frames
+}
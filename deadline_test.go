@@ -0,0 +1,153 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connPair returns both ends of a single stream.
+func connPair(t *testing.T, ctx context.Context) (net.Conn, net.Conn) {
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestReadDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, s := connPair(t, ctx)
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+
+	// Data that arrives after the timeout must not get lost.
+	data := []byte("late")
+	if _, err := s.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Time{})
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+func TestDeadlineExtended(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, s := connPair(t, ctx)
+
+	// Moving the deadline into the future while a Read is blocked keeps
+	// the Read waiting.
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	go func() {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		time.Sleep(100 * time.Millisecond)
+		s.Write([]byte("x"))
+	}()
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stalledWriter blocks on the first data frame written to it until it is
+// released. stalled is closed once it blocks.
+type stalledWriter struct {
+	w       io.Writer
+	once    sync.Once
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	if frameType(b[0]) == frameData {
+		w.once.Do(func() {
+			close(w.stalled)
+			<-w.release
+		})
+	}
+	return w.w.Write(b)
+}
+
+func TestWriteDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	go echo(Listen(ctx, p))
+	w := &stalledWriter{w: q, stalled: make(chan struct{}), release: make(chan struct{})}
+
+	// Control frames get through, the first data frame stalls.
+	c, err := Dial(ctx, &splitReadWriter{q, w})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	first := make(chan result, 1)
+	go func() {
+		n, err := c.Write([]byte("first"))
+		first <- result{n, err}
+	}()
+	<-w.stalled
+
+	// The next data frame times out in the queue.
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := c.Write([]byte("stalled"))
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing to be written, got %d bytes", n)
+	}
+
+	// The first one times out as well, but it is on its way already.
+	r := <-first
+	if !errors.As(r.err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", r.err)
+	}
+	if r.n != len("first") {
+		t.Fatalf("expected %d bytes to be written, got %d", len("first"), r.n)
+	}
+
+	// Only the data that was written reaches the peer.
+	close(w.release)
+	c.SetWriteDeadline(time.Time{})
+	if _, err := c.Write([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("firstlast"))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "firstlast" {
+		t.Fatalf("expected %q, got %q", "firstlast", got)
+	}
+}
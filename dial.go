@@ -4,15 +4,37 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
 	"net"
 )
 
 var ErrContextCanceled error = errors.New("context is done")
 
+// ErrConnReset is returned when the peer refused or aborted a stream.
+var ErrConnReset error = errors.New("connection reset by peer")
+
+// ErrProtocol is returned when the peer sent data that is not a valid frame.
+var ErrProtocol error = errors.New("protocol error")
+
+// Dial opens a new stream over p. Every call with the same p opens another
+// stream on the same underlying session, so many connections can share a
+// single io.ReadWriter. The peer accepts them with a Listener.
 func Dial(ctx context.Context, p io.ReadWriter, opts ...DialOption) (net.Conn, error) {
+	c, err := dial(ctx, p, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func dial(ctx context.Context, p io.ReadWriter, opts ...DialOption) (*conn, error) {
+	cfg := defaultSessionConfig()
+	applySessionOptions(&cfg, opts)
+	return openConn(ctx, sessionFor(p, true, cfg), opts...)
+}
+
+func openConn(ctx context.Context, s *session, opts ...DialOption) (*conn, error) {
 	// Create connection.
-	c, err := newConn(ctx, p)
+	c, err := s.open(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -20,35 +42,29 @@ func Dial(ctx context.Context, p io.ReadWriter, opts ...DialOption) (net.Conn, e
 	// Apply DialOptions.
 	for _, opt := range opts {
 		if err := opt.apply(c); err != nil {
+			c.Close()
 			return nil, err
 		}
 	}
+	c.announceWindow()
 
 	return c, err
 }
 
-type DialOption interface {
-	apply(*conn) error
+// Opener is implemented by every net.Conn returned by this package. Open
+// opens another stream over the same underlying io.ReadWriter, which the
+// peer accepts with its Listener.
+type Opener interface {
+	Open(ctx context.Context, opts ...DialOption) (net.Conn, error)
 }
 
-type dialOptionEventLogger log.Logger
-
-func (opt *dialOptionEventLogger) apply(c *conn) error {
-	c.setEventLogger((*log.Logger)(opt))
-	return nil
-}
-
-func WithEventLogger(logger *log.Logger) DialOption {
-	return (*dialOptionEventLogger)(logger)
-}
-
-type dialOptionErrorLogger log.Logger
-
-func (opt *dialOptionErrorLogger) apply(c *conn) error {
-	c.setErrorLogger((*log.Logger)(opt))
-	return nil
+// DialOption configures a conn.
+type DialOption interface {
+	apply(*conn) error
 }
 
-func WithErrorLogger(logger *log.Logger) DialOption {
-	return (*dialOptionErrorLogger)(logger)
+// Option configures both conns and listeners.
+type Option interface {
+	DialOption
+	ListenOption
 }
@@ -0,0 +1,186 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownEndpoint is returned by a Dialer for an address that no
+// endpoint is registered under.
+var ErrUnknownEndpoint error = errors.New("unknown endpoint")
+
+// Dialer connects to endpoints by name. An endpoint is anything that opens
+// conns, such as a pipe pair served with ListenPipe, a CommandEndpoint or a
+// WASMPool.
+//
+// DialContext has the signature of net.Dialer.DialContext, so a Dialer can
+// be used for http.Transport, or with grpc.WithContextDialer through a
+// small adapter. The zero value is ready to use.
+type Dialer struct {
+	// Options are applied to every conn the Dialer opens.
+	Options []DialOption
+
+	mu        sync.RWMutex
+	endpoints map[string]Opener
+}
+
+// Register makes e available under name, replacing any endpoint that was
+// registered under it before.
+func (d *Dialer) Register(name string, e Opener) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.endpoints == nil {
+		d.endpoints = make(map[string]Opener)
+	}
+	d.endpoints[name] = e
+}
+
+// Unregister removes the endpoint registered under name. Conns to it stay
+// open.
+func (d *Dialer) Unregister(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.endpoints, name)
+}
+
+// lookup returns the endpoint registered under address, or published with
+// ListenName. The address may be prefixed with "io:", and an address with a
+// port, as passed by http.Transport, also matches the name of its host.
+func (d *Dialer) lookup(address string) (string, Opener, bool) {
+	name := strings.TrimPrefix(address, "io:")
+	if e, ok := d.find(name); ok {
+		return name, e, true
+	}
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		if e, ok := d.find(host); ok {
+			return host, e, true
+		}
+	}
+	return "", nil, false
+}
+
+func (d *Dialer) find(name string) (Opener, bool) {
+	d.mu.RLock()
+	e, ok := d.endpoints[name]
+	d.mu.RUnlock()
+	if ok {
+		return e, true
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	e, ok = registry.endpoints[name]
+	return e, ok
+}
+
+// Dial is like DialContext without a context.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext opens a conn to the endpoint registered under address, or
+// else published with ListenName. The network is ignored, because clients
+// like http.Transport always dial "tcp". The RemoteAddr of the conn is an
+// Addr with the name of the endpoint.
+//
+// Unlike with Dial, ctx only bounds the dial itself. The conn stays open
+// until it is closed or its endpoint goes away.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	name, e, ok := d.lookup(address)
+	if !ok {
+		return nil, opError(fmt.Errorf("%w %q", ErrUnknownEndpoint, address))
+	}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		opts := append(append([]DialOption(nil), d.Options...), dialOptionName(name))
+		c, err := e.Open(context.Background(), opts...)
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, opError(r.err)
+		}
+		return r.c, nil
+	case <-ctx.Done():
+		// The endpoint may still come up with a conn, which nobody wants
+		// anymore.
+		go func() {
+			if r := <-done; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, opError(ErrContextCanceled)
+	}
+}
+
+// ListenPipe creates a pipe pair and registers one end under name. The
+// returned Listener serves the other end and accepts the conns dialed to
+// name. Closing the Listener unregisters name and closes the pipe.
+func (d *Dialer) ListenPipe(ctx context.Context, name string, opts ...ListenOption) net.Listener {
+	l, e := listenPipe(ctx, name, opts)
+	d.Register(name, e)
+	l.atClose(func() {
+		d.mu.Lock()
+		if d.endpoints[name] == Opener(e) {
+			delete(d.endpoints, name)
+		}
+		d.mu.Unlock()
+	})
+	return l
+}
+
+// listenPipe serves a Listener called name on one end of a new pipe pair,
+// and returns an endpoint for the other end. Closing the Listener closes
+// the pipe.
+func listenPipe(ctx context.Context, name string, opts []ListenOption) (*listener, pipeEndpoint) {
+	a, b := PipePair()
+	l := listen(ctx, b, append(opts, listenOptionName(name))...)
+	l.atClose(func() {
+		a.Close()
+		b.Close()
+	})
+	return l, pipeEndpoint{a}
+}
+
+// pipeEndpoint opens streams over its end of a pipe pair.
+type pipeEndpoint struct {
+	p io.ReadWriter
+}
+
+func (e pipeEndpoint) Open(ctx context.Context, opts ...DialOption) (net.Conn, error) {
+	return Dial(ctx, e.p, opts...)
+}
+
+// OpenerFunc adapts a function to the Opener interface, for example to
+// register a custom endpoint with a Dialer.
+type OpenerFunc func(ctx context.Context, opts ...DialOption) (net.Conn, error)
+
+func (f OpenerFunc) Open(ctx context.Context, opts ...DialOption) (net.Conn, error) {
+	return f(ctx, opts...)
+}
+
+type dialOptionName string
+
+func (opt dialOptionName) apply(c *conn) error {
+	c.remoteName = string(opt)
+	return nil
+}
+
+type listenOptionName string
+
+func (opt listenOptionName) applyListener(l *listener) {
+	l.name = string(opt)
+}
@@ -0,0 +1,92 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDialerPipe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var d Dialer
+	l := d.ListenPipe(ctx, "echo")
+	go echo(l)
+
+	c, err := d.DialContext(ctx, "io", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	data := []byte("hello endpoint")
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+
+	if _, err := d.DialContext(ctx, "io", "nope"); !errors.Is(err, ErrUnknownEndpoint) {
+		t.Fatalf("expected ErrUnknownEndpoint, got %v", err)
+	}
+	l.Close()
+	if _, err := d.DialContext(ctx, "io", "echo"); !errors.Is(err, ErrUnknownEndpoint) {
+		t.Fatalf("expected ErrUnknownEndpoint after Close, got %v", err)
+	}
+}
+
+func TestDialerHTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var d Dialer
+	l := d.ListenPipe(ctx, "web")
+	defer l.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	defer client.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://web/there", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello /there" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+}
+
+func TestDialerCanceled(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	var d Dialer
+	d.Register("stuck", OpenerFunc(func(context.Context, ...DialOption) (net.Conn, error) {
+		<-stuck
+		return nil, net.ErrClosed
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "io", "stuck"); !errors.Is(err, ErrContextCanceled) {
+		t.Fatalf("expected ErrContextCanceled, got %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package stdl
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// exitWait bounds how long a failed write to a child process, or a read
+// that reached the end of its stdout, waits for the process to exit, so
+// that its exit status can be reported instead of a broken pipe or io.EOF.
+const exitWait = time.Second
+
+// command is the transport to a child process: it reads from the process's
+// stdout and writes to its stdin.
+type command struct {
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *os.File
+
+	exited chan struct{}
+	err    error
+}
+
+// Read reads from the process's stdout. If the process exits with a
+// non-zero status once its stdout is closed, the status is returned instead
+// of io.EOF. A process that closes its stdout but keeps running gets io.EOF.
+func (c *command) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if err == io.EOF {
+		select {
+		case <-c.exited:
+			if c.err != nil {
+				err = c.err
+			}
+		case <-time.After(exitWait):
+		}
+	}
+	return n, err
+}
+
+// Write writes to the process's stdin. If the process has gone away, its
+// exit status is returned instead of the write error.
+func (c *command) Write(b []byte) (int, error) {
+	n, err := c.stdin.Write(b)
+	if err != nil {
+		select {
+		case <-c.exited:
+			if c.err != nil {
+				err = c.err
+			}
+		case <-time.After(exitWait):
+		}
+	}
+	return n, err
+}
+
+func (c *command) wait() {
+	c.err = c.cmd.Wait()
+	close(c.exited)
+}
+
+// kill stops the process and waits for it to exit.
+func (c *command) kill() {
+	c.cmd.Process.Kill()
+	<-c.exited
+	c.stdin.Close()
+	c.stdout.Close()
+}
+
+// cmdConn is a conn to a child process. Closing it stops the process.
+type cmdConn struct {
+	*conn
+	c    *command
+	once sync.Once
+}
+
+func (c *cmdConn) Close() error {
+	err := c.conn.Close()
+	c.once.Do(c.c.kill)
+	return err
+}
+
+// DialCommand starts cmd and returns a net.Conn over its stdin and stdout.
+// The process is expected to serve a Listener on its stdio. Unless cmd has
+// its own Stderr, every line the process writes to stderr is sent to the
+// error logger of the conn.
+//
+// Closing the conn, or ctx being done, kills the process and waits for it.
+// If the process exits with a non-zero status, the next Read or Write on
+// the conn returns the *exec.ExitError.
+func DialCommand(ctx context.Context, cmd *exec.Cmd, opts ...DialOption) (net.Conn, error) {
+	p, stderr, err := startCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// The process may explain on stderr why dial fails.
+	logged := make(chan struct{})
+	if stderr != nil {
+		go func() {
+			logLines(stderr, errorLoggerOf(opts))
+			close(logged)
+		}()
+	} else {
+		close(logged)
+	}
+
+	c, err := dial(ctx, p, opts...)
+	if err != nil {
+		p.kill()
+		select {
+		case <-logged:
+		case <-time.After(exitWait):
+		}
+		return nil, err
+	}
+
+	cc := &cmdConn{conn: c, c: p}
+	go func() {
+		select {
+		case <-ctx.Done():
+			cc.once.Do(p.kill)
+		case <-p.exited:
+		}
+	}()
+	return cc, nil
+}
+
+// startCommand starts cmd with pipes for its stdin and stdout. Unless cmd
+// has its own Stderr, the read end of a pipe for its stderr is returned as
+// well.
+func startCommand(cmd *exec.Cmd) (*command, *os.File, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, nil, err
+	}
+	files := []*os.File{inR, inW, outR, outW}
+	cmd.Stdin, cmd.Stdout = inR, outW
+	var errR *os.File
+	if cmd.Stderr == nil {
+		var errW *os.File
+		if errR, errW, err = os.Pipe(); err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		cmd.Stderr = errW
+		files = append(files, errR, errW)
+	}
+	if err := cmd.Start(); err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+	// Only the child needs its ends of the pipes.
+	inR.Close()
+	outW.Close()
+	if errR != nil {
+		cmd.Stderr.(*os.File).Close()
+	}
+
+	p := &command{cmd: cmd, stdin: inW, stdout: outR, exited: make(chan struct{})}
+	go p.wait()
+	return p, errR, nil
+}
+
+// logLines logs every line read from f as a warning, until f ends.
+func logLines(f *os.File, logger *slog.Logger) {
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		logger.Warn(s.Text())
+	}
+}
+
+// CommandEndpoint is a child process that a Dialer connects to. The process
+// is started by the first Open, and every conn is another stream over its
+// stdio. If the process has exited, the next Open starts a new one.
+type CommandEndpoint struct {
+	newCmd func() *exec.Cmd
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	p      *command
+	closed bool
+}
+
+// NewCommandEndpoint returns an endpoint that starts its processes with
+// newCmd. Unless the command has its own Stderr, every line a process
+// writes to stderr is sent to logger, or to the logger set with
+// SetDefaultLogger if logger is nil.
+func NewCommandEndpoint(newCmd func() *exec.Cmd, logger *slog.Logger) *CommandEndpoint {
+	return &CommandEndpoint{newCmd: newCmd, logger: logger}
+}
+
+// Open opens a stream to the process, starting it if needed.
+func (e *CommandEndpoint) Open(ctx context.Context, opts ...DialOption) (net.Conn, error) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if e.p == nil || isClosed(e.p.exited) {
+		if e.p != nil {
+			// Release the pipes of the process that exited.
+			e.p.kill()
+		}
+		p, stderr, err := startCommand(e.newCmd())
+		if err != nil {
+			e.mu.Unlock()
+			return nil, err
+		}
+		if stderr != nil {
+			logger := e.logger
+			if logger == nil {
+				logger = defaultLogger
+			}
+			go logLines(stderr, logger)
+		}
+		e.p = p
+	}
+	p := e.p
+	e.mu.Unlock()
+
+	cfg := defaultSessionConfig()
+	applySessionOptions(&cfg, opts)
+	c, err := openConn(ctx, sessionFor(p, true, cfg), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close kills the running process, if any, and waits for it.
+func (e *CommandEndpoint) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return net.ErrClosed
+	}
+	e.closed = true
+	if e.p != nil {
+		e.p.kill()
+	}
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aksial/stdl/testdata/grpc/arithmetic/server"
+)
+
+// helperCommand returns a command that runs TestHelperProcess in a child
+// process, serving a listener on its stdio.
+func helperCommand(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "STDL_HELPER="+mode)
+	return cmd
+}
+
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("STDL_HELPER")
+	if mode == "" {
+		return
+	}
+	if mode == "broken" {
+		fmt.Fprintln(os.Stderr, "cannot start")
+		os.Exit(2)
+	}
+	stdout := os.Stdout
+	l := ListenStdio(context.Background())
+	if mode == "arithmetic" {
+		if err := ServeGRPC(context.Background(), l, server.New()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if mode == "chatty" {
+		// Ends up on stderr instead of corrupting the stream.
+		fmt.Println("oops")
+	}
+	c, err := l.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	switch mode {
+	case "echo", "chatty":
+		io.Copy(c, c)
+		c.Close()
+		os.Exit(0)
+	case "fail":
+		c.Read(make([]byte, 1))
+		fmt.Fprintln(os.Stderr, "giving up")
+		os.Exit(3)
+	case "linger":
+		// Keeps running until killed.
+		stdout.Close()
+		select {}
+	}
+}
+
+func TestDialCommand(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := DialCommand(ctx, helperCommand("echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := []byte("hello child")
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+// lineWriter sends everything written to it on a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func TestDialCommandExitStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	stderr := make(lineWriter, 16)
+	c, err := DialCommand(ctx, helperCommand("fail"), WithErrorLogger(log.New(stderr, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Read(make([]byte, 1))
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+	// The child's stderr ends up in the error logger.
+	for line := range stderr {
+		if line == "giving up\n" {
+			break
+		}
+	}
+}
+
+func TestDialCommandClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	cmd := helperCommand("echo")
+	c, err := DialCommand(ctx, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for the process.
+	if cmd.ProcessState == nil {
+		t.Fatal("process still running after Close")
+	}
+}
+
+func TestDialCommandFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// The child's stderr is logged even if dialing it fails.
+	stderr := make(lineWriter, 16)
+	_, err := DialCommand(ctx, helperCommand("broken"), WithHandshake(), WithLogger(slog.New(slog.NewTextHandler(stderr, nil))))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for {
+		select {
+		case line := <-stderr:
+			if strings.Contains(line, "msg=\"cannot start\"") {
+				return
+			}
+		default:
+			t.Fatal("stderr of the child not logged")
+		}
+	}
+}
+
+func TestDialCommandStdoutClosed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := DialCommand(ctx, helperCommand("linger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The conn ends although the child is still running.
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	case <-time.After(exitWait * 3):
+		t.Fatal("Read still blocked after the child closed its stdout")
+	}
+}
+
+func TestCommandEndpointLogger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	stderr := make(lineWriter, 16)
+	e := NewCommandEndpoint(func() *exec.Cmd { return helperCommand("chatty") }, slog.New(slog.NewTextHandler(stderr, nil)))
+	defer e.Close()
+	c, err := e.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The child's stderr ends up in the logger of the endpoint.
+	for line := range stderr {
+		if strings.Contains(line, "msg=oops") {
+			break
+		}
+	}
+}
+
+func TestListenStdioRedirect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	stderr := make(lineWriter, 16)
+	c, err := DialCommand(ctx, helperCommand("chatty"), WithErrorLogger(log.New(stderr, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The stray output of the child does not disturb the conn.
+	data := []byte("still fine")
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+	for line := range stderr {
+		if line == "oops\n" {
+			break
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package stdl
+
+import (
+	"net"
+	"os"
+)
+
+// Every stream starts with initialWindow bytes of credit in both
+// directions. A conn with a larger window grants the difference right after
+// the stream is opened or accepted.
+const (
+	initialWindow     = 64 << 10
+	defaultWindowSize = 256 << 10
+)
+
+// WithWindowSize sets how many bytes the peer may send on a conn before the
+// conn has read them, which bounds the data buffered for the conn. The
+// writer on the peer's side blocks once it has used up the window, without
+// affecting other streams over the same transport. The window defaults to
+// 256 KiB and cannot be smaller than 64 KiB. Given to Listen, it applies to
+// the conns the listener accepts.
+func WithWindowSize(n int) Option {
+	if n < initialWindow {
+		n = initialWindow
+	}
+	return optionWindowSize(n)
+}
+
+type optionWindowSize int
+
+func (opt optionWindowSize) apply(c *conn) error {
+	c.window = int(opt)
+	return nil
+}
+
+func (opt optionWindowSize) applyListener(l *listener) {
+	l.window = int(opt)
+}
+
+// announceWindow grants the peer the part of the window of c beyond the
+// initial one.
+func (c *conn) announceWindow() {
+	c.mu.Lock()
+	inc := c.window - initialWindow
+	if inc <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.recvCredit += inc
+	c.mu.Unlock()
+	c.s.windowUpdate(c.id, inc)
+}
+
+// consumed accounts for n bytes taken from the buffer of c by Read, and
+// returns the credit to grant the peer. Credit is granted in batches of
+// half a window. It must be called with c.mu held.
+func (c *conn) consumed(n int) int {
+	c.unacked += n
+	if c.unacked < c.window/2 || c.remoteClosed || c.reset {
+		return 0
+	}
+	inc := c.unacked
+	c.unacked = 0
+	c.recvCredit += inc
+	return inc
+}
+
+// discard drops the data buffered for c, which is no longer read, and
+// returns the credit to grant the peer. It must be called with c.mu held.
+func (c *conn) discard() int {
+	inc := c.buf.Len() + c.unacked
+	c.buf.Reset()
+	c.unacked = 0
+	if c.remoteClosed || c.reset {
+		return 0
+	}
+	c.recvCredit += inc
+	return inc
+}
+
+// grant sends a window update for inc bytes, if any.
+func (c *conn) grant(inc int) {
+	if inc > 0 {
+		c.s.windowUpdate(c.id, inc)
+	}
+}
+
+// takeCredit waits until the peer lets c send data, and returns how much
+// of n it may send now.
+func (c *conn) takeCredit(n int) (int, error) {
+	for {
+		c.mu.Lock()
+		var err error
+		switch {
+		case c.writeClosed:
+			err = net.ErrClosed
+		case c.reset:
+			err = c.resetErr
+		case c.sendCredit > 0:
+			if n > c.sendCredit {
+				n = c.sendCredit
+			}
+			c.sendCredit -= n
+			c.mu.Unlock()
+			return n, nil
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-c.writable:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.ctx.Done():
+			return 0, ErrContextCanceled
+		case <-c.writeDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.s.done:
+			return 0, c.s.err
+		}
+	}
+}
+
+// addCredit adds credit granted by the peer, or given back because it
+// was not used.
+func (c *conn) addCredit(n int) {
+	c.mu.Lock()
+	c.sendCredit += n
+	c.mu.Unlock()
+	c.wakeWriter()
+}
+
+func (c *conn) wakeWriter() {
+	select {
+	case c.writable <- struct{}{}:
+	default:
+	}
+}
+
+// windowUpdate queues a frame that grants the peer n more bytes on the
+// stream id. Like control, it never blocks.
+func (s *session) windowUpdate(id uint32, n int) {
+	s.ctrl.addWindow(id, n)
+}
@@ -0,0 +1,197 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// fill writes to c until the write deadline passes, and returns how much
+// it wrote.
+func fill(t *testing.T, c interface {
+	Write([]byte) (int, error)
+	SetWriteDeadline(time.Time) error
+}) int {
+	t.Helper()
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := c.Write(make([]byte, 1<<20))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	return n
+}
+
+func TestFlowControlSlowReader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	slow, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Nobody reads s, so the writer stops after a window.
+	if n := fill(t, slow); n != defaultWindowSize {
+		t.Fatalf("expected to write %d bytes, wrote %d", defaultWindowSize, n)
+	}
+	sc := s.(*conn)
+	sc.mu.Lock()
+	buffered := sc.buf.Len()
+	sc.mu.Unlock()
+	if buffered > defaultWindowSize {
+		t.Fatalf("%d bytes buffered, more than the window", buffered)
+	}
+
+	// Another stream over the same transport is not affected.
+	fast, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	e, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(e, e)
+	msg := bytes.Repeat([]byte("x"), 1<<20)
+	go fast.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(fast, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo differs")
+	}
+
+	// Once s is read, the writer goes on.
+	go io.Copy(io.Discard, s)
+	slow.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := slow.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	const window = 128 << 10
+	p, q := PipePair()
+	l := Listen(ctx, p, WithWindowSize(window))
+	defer l.Close()
+	c, err := Dial(ctx, q, WithWindowSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if n := fill(t, c); n != window {
+		t.Fatalf("expected to write %d bytes, wrote %d", window, n)
+	}
+	// The window of the client was raised to the initial one.
+	if n := fill(t, s.(*conn)); n != initialWindow {
+		t.Fatalf("expected to write %d bytes, wrote %d", initialWindow, n)
+	}
+}
+
+func TestFlowControlViolation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, WithWindowSize(initialWindow))
+	defer l.Close()
+
+	// A peer that ignores the window gets the stream reset.
+	q.Write(appendFrame(nil, header{typ: frameOpen, stream: 1}, nil))
+	payload := make([]byte, maxFramePayload)
+	for i := 0; i <= initialWindow/maxFramePayload; i++ {
+		q.Write(appendFrame(nil, header{typ: frameData, stream: 1}, payload))
+	}
+	hdr := make([]byte, headerSize)
+	for {
+		h, _, err := readFrame(q, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.typ == frameReset {
+			if h.stream != 1 {
+				t.Fatalf("unexpected reset of stream %d", h.stream)
+			}
+			break
+		}
+	}
+}
+
+func TestFlowControlCloseRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Data that is no longer read does not hold up the writer.
+	if err := s.(*conn).CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write(make([]byte, 4*defaultWindowSize)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowUpdatesCoalesce(t *testing.T) {
+	// Updates for the same stream add up to one frame, in the order in
+	// which the streams got their first update.
+	q := newControlQueue()
+	q.addWindow(3, 10)
+	q.addWindow(1, 5)
+	q.addWindow(3, 20)
+	frames := q.take()
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+	for i, want := range []struct{ stream, inc uint32 }{{3, 30}, {1, 5}} {
+		h, payload, err := readFrame(bytes.NewReader(frames[i].b), make([]byte, headerSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.typ != frameWindow || h.stream != want.stream || binary.BigEndian.Uint32(payload) != want.inc {
+			t.Fatalf("expected a window update of %d for stream %d, got %v %d %x", want.inc, want.stream, h.typ, h.stream, payload)
+		}
+	}
+	if frames := q.take(); len(frames) != 0 {
+		t.Fatalf("expected no frames, got %d", len(frames))
+	}
+}
@@ -0,0 +1,137 @@
+package stdl
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Every frame starts with a fixed size header:
+//
+//	type(1) flags(1) stream(4) length(4)
+//
+// followed by length bytes of payload. All integers are big endian.
+const headerSize = 10
+
+// maxFramePayload limits the payload of a single frame. Larger writes are
+// split into several data frames.
+const maxFramePayload = 16 << 10
+
+type frameType uint8
+
+const (
+	// frameData carries stream payload.
+	frameData frameType = iota
+	// frameOpen announces a new stream to the peer.
+	frameOpen
+	// frameReset tells the peer that a stream was refused or aborted.
+	frameReset
+	// frameClose tells the peer that no more data follows on a stream.
+	frameClose
+	// frameWindow grants the peer more credit on a stream. Its payload is
+	// the number of bytes as a 32-bit integer.
+	frameWindow
+	// framePing asks the peer to answer with a framePong. Neither has a
+	// stream or a payload.
+	framePing
+	framePong
+	// frameAck tells the peer in reliable mode up to which sequence number
+	// it received the records, as a 32-bit integer.
+	frameAck
+	// frameToken hands the listener of a resumable session the token that
+	// authenticates Resume.
+	frameToken
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameData:
+		return "data"
+	case frameOpen:
+		return "open"
+	case frameReset:
+		return "reset"
+	case frameClose:
+		return "close"
+	case frameWindow:
+		return "window"
+	case framePing:
+		return "ping"
+	case framePong:
+		return "pong"
+	case frameAck:
+		return "ack"
+	case frameToken:
+		return "token"
+	}
+	return "unknown"
+}
+
+type header struct {
+	typ    frameType
+	flags  uint8
+	stream uint32
+	length uint32
+}
+
+// valid tells whether h has a known type and a payload length that fits
+// it.
+func (h header) valid() bool {
+	switch h.typ {
+	case frameData, frameOpen, frameReset, frameClose:
+		return h.length <= maxFramePayload
+	case frameWindow, frameAck:
+		return h.length == 4
+	case framePing, framePong:
+		return h.length == 0
+	case frameToken:
+		return h.length == tokenSize
+	}
+	return false
+}
+
+func (h header) encode(b []byte) {
+	b[0] = byte(h.typ)
+	b[1] = h.flags
+	binary.BigEndian.PutUint32(b[2:6], h.stream)
+	binary.BigEndian.PutUint32(b[6:10], h.length)
+}
+
+func (h *header) decode(b []byte) {
+	h.typ = frameType(b[0])
+	h.flags = b[1]
+	h.stream = binary.BigEndian.Uint32(b[2:6])
+	h.length = binary.BigEndian.Uint32(b[6:10])
+}
+
+// readFrame reads a single frame from r. The returned payload is freshly
+// allocated and owned by the caller.
+func readFrame(r io.Reader, hdr []byte) (h header, payload []byte, err error) {
+	if _, err = io.ReadFull(r, hdr[:headerSize]); err != nil {
+		return
+	}
+	h.decode(hdr)
+	if !h.valid() {
+		err = ErrProtocol
+		return
+	}
+	if h.length > 0 {
+		payload = make([]byte, h.length)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	return
+}
+
+// appendFrame encodes a frame into a single buffer so that it can be
+// written to the transport with one call.
+func appendFrame(b []byte, h header, payload []byte) []byte {
+	h.length = uint32(len(payload))
+	var hdr [headerSize]byte
+	h.encode(hdr[:])
+	b = append(b, hdr[:]...)
+	return append(b, payload...)
+}
@@ -9,14 +9,14 @@ func TestFundamentals(t *testing.T) {
 	p := Pipe()
 
 	// Create a goroutine that will read once from the pipe, and then
-	// put the number of written bytes to the result channel.
+	// put the number of written bytes to the result channel. Errors are
+	// handed back too, as t.Fatal must not be called from the goroutine.
 	res := make(chan int)
+	errs := make(chan error, 1)
 	go func() {
 		buf := make([]byte, 256)
 		n, err := p.Read(buf)
-		if err != nil {
-			t.Fatal(err)
-		}
+		errs <- err
 		res <- n
 	}()
 
@@ -33,6 +33,9 @@ func TestFundamentals(t *testing.T) {
 	// bytes the goroutine we created earlier read from the pipe, compare to the
 	// number of bytes we wrote to the pipe.
 	m := <-res
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
 	if m != n {
 		t.Fail()
 	}
@@ -0,0 +1,58 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// GRPCDialer returns a dialer for grpc.WithContextDialer that opens a new
+// stream over o for every connection gRPC makes, typically with o being a
+// conn returned by DialCommand or DialWASM:
+//
+//	cc, err := grpc.NewClient("passthrough:///plugin",
+//		grpc.WithTransportCredentials(insecure.NewCredentials()),
+//		grpc.WithContextDialer(stdl.GRPCDialer(ctx, c)))
+//
+// gRPC cancels the context of a dial once it is done, but the context of a
+// stream bounds its whole lifetime. The streams are therefore opened with
+// ctx, and the context passed by gRPC only stops a dial that has not
+// started yet.
+func GRPCDialer(ctx context.Context, o Opener, opts ...DialOption) func(context.Context, string) (net.Conn, error) {
+	return func(dialCtx context.Context, _ string) (net.Conn, error) {
+		if err := dialCtx.Err(); err != nil {
+			return nil, err
+		}
+		return o.Open(ctx, opts...)
+	}
+}
+
+// GRPCServer is the part of *grpc.Server that ServeGRPC uses.
+type GRPCServer interface {
+	Serve(net.Listener) error
+	GracefulStop()
+}
+
+// ServeGRPC serves s on l until ctx is done, l is closed or the peer goes
+// away, for example with a listener from ListenStdio. Once ctx is done, s
+// is stopped gracefully, which lets pending calls finish, and l is closed.
+// None of these is an error, so ServeGRPC then returns nil.
+func ServeGRPC(ctx context.Context, l net.Listener, s GRPCServer) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.GracefulStop()
+			l.Close()
+		case <-stopped:
+		}
+	}()
+
+	err := s.Serve(l)
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+//go:build !wasip1
+
+package stdl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/aksial/stdl/testdata/grpc/arithmetic/arithmetic"
+	"github.com/aksial/stdl/testdata/grpc/arithmetic/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// arithmeticClient connects to the Arithmetic service served behind c.
+func arithmeticClient(t *testing.T, ctx context.Context, c Opener) arithmetic.ArithmeticClient {
+	cc, err := grpc.NewClient("passthrough:///arithmetic",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(GRPCDialer(ctx, c)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return arithmetic.NewArithmeticClient(cc)
+}
+
+func testArithmetic(t *testing.T, ctx context.Context, a arithmetic.ArithmeticClient) {
+	for _, tc := range []struct {
+		name   string
+		call   func(context.Context, *arithmetic.Many, ...grpc.CallOption) (*arithmetic.One, error)
+		values []float64
+		want   float64
+	}{
+		{"Add", a.Add, []float64{1, 2, 3.5}, 6.5},
+		{"Sub", a.Sub, []float64{10, 2, 3}, 5},
+		{"Mul", a.Mul, []float64{2, 3, 4}, 24},
+		{"Div", a.Div, []float64{12, 2, 3}, 2},
+	} {
+		res, err := tc.call(ctx, &arithmetic.Many{Values: tc.values})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.Value != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, res.Value)
+		}
+	}
+
+	// Errors of the service reach the client with their code.
+	_, err := a.Div(ctx, &arithmetic.Many{Values: []float64{1, 0}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+
+	// A call that is canceled, or runs out of time, ends early on both
+	// sides and leaves the connection usable.
+	slow := metadata.AppendToOutgoingContext(ctx, server.DelayKey, "60000")
+	timeoutCtx, cancel := context.WithTimeout(slow, 100*time.Millisecond)
+	defer cancel()
+	_, err = a.Add(timeoutCtx, &arithmetic.Many{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	cancelCtx, cancel := context.WithCancel(slow)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = a.Add(cancelCtx, &arithmetic.Many{})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if _, err := a.Add(ctx, &arithmetic.Many{Values: []float64{1}}); err != nil {
+		t.Errorf("call after cancellation failed: %v", err)
+	}
+}
+
+func TestGRPCCommand(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, err := DialCommand(ctx, helperCommand("arithmetic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testArithmetic(t, ctx, arithmeticClient(t, ctx, c.(Opener)))
+}
+
+func TestGRPCWASM(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiling the guest takes a while")
+	}
+	ctx := testContext(t)
+	rt := newWASIRuntime(t, ctx)
+
+	c, err := DialWASM(ctx, rt, arithmeticModule.get(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testArithmetic(t, ctx, arithmeticClient(t, ctx, c.(Opener)))
+}
+
+func TestServeGRPCStop(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	a, b := PipePair()
+	defer a.Close()
+	defer b.Close()
+
+	serveCtx, stop := context.WithCancel(ctx)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeGRPC(serveCtx, Listen(serveCtx, b), server.New())
+	}()
+
+	c, err := Dial(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	arith := arithmeticClient(t, ctx, c.(Opener))
+	if _, err := arith.Add(ctx, &arithmetic.Many{Values: []float64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("ServeGRPC did not return")
+	}
+}
+
+func TestDialerCommand(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	e := NewCommandEndpoint(func() *exec.Cmd { return helperCommand("arithmetic") }, nil)
+	var d Dialer
+	d.Register("arithmetic", e)
+
+	// Both gRPC connections share the same process.
+	for i := 0; i < 2; i++ {
+		a := arithmeticClient(t, ctx, OpenerFunc(func(ctx context.Context, _ ...DialOption) (net.Conn, error) {
+			return d.DialContext(ctx, "io", "arithmetic")
+		}))
+		testArithmetic(t, ctx, a)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(ctx, "io", "arithmetic"); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+}
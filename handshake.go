@@ -0,0 +1,183 @@
+package stdl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Features is a bitmap of protocol features that the two ends of a
+// transport announce in the handshake. A feature is used if both ends
+// announce it.
+type Features uint32
+
+const (
+	// FeatureMux is multiplexing streams over the transport. Every
+	// version of stdl requires it.
+	FeatureMux Features = 1 << iota
+	// FeatureCompression is compressed frame payloads.
+	FeatureCompression
+	// FeatureChecksums is frames protected by a checksum.
+	FeatureChecksums
+	// FeatureReliable is frames that are acknowledged and sent again if
+	// they get lost.
+	FeatureReliable
+)
+
+func (f Features) String() string {
+	var names []string
+	for _, feature := range []struct {
+		f    Features
+		name string
+	}{
+		{FeatureMux, "mux"},
+		{FeatureCompression, "compression"},
+		{FeatureChecksums, "checksums"},
+		{FeatureReliable, "reliable"},
+	} {
+		if f&feature.f != 0 {
+			names = append(names, feature.name)
+			f &^= feature.f
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return fmt.Sprint(names)
+}
+
+// protocolVersion is the version of the framing that this package speaks.
+// minProtocolVersion is the oldest one it still understands. Version 2
+// added flow control, without which a peer would stall, and version 3
+// keepalive pings, which a peer must answer.
+const (
+	protocolVersion    = 3
+	minProtocolVersion = 3
+)
+
+// handshakeMagic starts the hello that each end sends when the handshake
+// is enabled. As a frame header, it would have an unknown type, so a peer
+// without the handshake tells it apart from frames.
+var handshakeMagic = [4]byte{'S', 'T', 'D', 'L'}
+
+// helloSize is the size of a hello, which is
+//
+//	magic(4) version(2) features(4)
+//
+// with integers in big endian.
+const helloSize = 10
+
+// ErrHandshake is wrapped by the errors of a failed handshake.
+var ErrHandshake error = errors.New("handshake failed")
+
+// HandshakeError is returned by Dial and Accept when the peer does not
+// speak a compatible protocol. It wraps ErrHandshake.
+type HandshakeError struct {
+	// Reason describes the mismatch.
+	Reason string
+	// PeerVersion and PeerFeatures are what the peer announced, if it sent
+	// a hello at all.
+	PeerVersion  uint16
+	PeerFeatures Features
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrHandshake, e.Reason)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrHandshake
+}
+
+// WithHandshake makes Dial and Listen start the session over their
+// transport with a handshake, in which both ends exchange magic bytes,
+// their protocol version and the features they support. Dial waits for the
+// handshake until its ctx is done, and fails with a *HandshakeError if the
+// peer is not compatible. A Listener returns the *HandshakeError from
+// Accept.
+//
+// Both ends must enable the handshake. An end without it fails with a
+// *HandshakeError as well when it receives a hello. The option has no
+// effect if a session already runs over the transport.
+func WithHandshake() Option {
+	return optionHandshake{}
+}
+
+type optionHandshake struct{}
+
+func (optionHandshake) apply(*conn) error {
+	return nil
+}
+
+func (optionHandshake) applyListener(*listener) {}
+
+func (optionHandshake) applySession(cfg *sessionConfig) {
+	cfg.handshake = true
+}
+
+// sessionOption is implemented by options that configure the session
+// started by Dial or Listen.
+type sessionOption interface {
+	applySession(*sessionConfig)
+}
+
+// applySessionOptions applies the sessionOptions among opts to cfg.
+func applySessionOptions[T any](cfg *sessionConfig, opts []T) {
+	for _, opt := range opts {
+		if so, ok := any(opt).(sessionOption); ok {
+			so.applySession(cfg)
+		}
+	}
+}
+
+// appendHello appends the hello of an end supporting features.
+func appendHello(b []byte, features Features) []byte {
+	b = append(b, handshakeMagic[:]...)
+	b = binary.BigEndian.AppendUint16(b, protocolVersion)
+	return binary.BigEndian.AppendUint32(b, uint32(features))
+}
+
+// readHello reads the hello of the peer from r and returns the features
+// that both ends support.
+func readHello(r io.Reader, features Features) (Features, error) {
+	var b [helloSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, &HandshakeError{Reason: "truncated hello"}
+		}
+		return 0, err
+	}
+	if !bytes.Equal(b[:4], handshakeMagic[:]) {
+		return 0, &HandshakeError{Reason: fmt.Sprintf("bad magic % x", b[:4])}
+	}
+	e := &HandshakeError{
+		PeerVersion:  binary.BigEndian.Uint16(b[4:]),
+		PeerFeatures: Features(binary.BigEndian.Uint32(b[6:])),
+	}
+	switch {
+	case e.PeerVersion < minProtocolVersion:
+		e.Reason = fmt.Sprintf("peer speaks version %d, need at least %d", e.PeerVersion, minProtocolVersion)
+		return 0, e
+	case e.PeerFeatures&FeatureMux == 0:
+		e.Reason = "peer does not support multiplexing"
+		return 0, e
+	case (features^e.PeerFeatures)&FeatureChecksums != 0:
+		// Checksums change the framing, so both ends must use them.
+		e.Reason = "only one end uses checksums"
+		return 0, e
+	case (features^e.PeerFeatures)&FeatureReliable != 0:
+		e.Reason = "only one end uses reliable delivery"
+		return 0, e
+	}
+	return features & e.PeerFeatures, nil
+}
+
+// isHello tells whether a frame header is the start of a hello.
+func isHello(hdr []byte) bool {
+	return bytes.HasPrefix(hdr, handshakeMagic[:])
+}
@@ -0,0 +1,121 @@
+package stdl
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, WithHandshake())
+	defer l.Close()
+	go echo(l)
+	c, err := Dial(ctx, q, WithHandshake())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if f := c.(*conn).s.features; f != FeatureMux {
+		t.Fatalf("expected features %s, got %s", FeatureMux, f)
+	}
+}
+
+func TestHandshakeOneSided(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// Only the dialer sends a hello. The listener rejects it, and Dial
+	// gives up once its context is done.
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	dialCtx, dialCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer dialCancel()
+	start := time.Now()
+	if _, err := Dial(dialCtx, q, WithHandshake()); err != ErrContextCanceled {
+		t.Fatalf("expected %v, got %v", ErrContextCanceled, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Dial took %s", d)
+	}
+	var he *HandshakeError
+	if _, err := l.Accept(); !errors.As(err, &he) || he.Reason != "peer sent a hello, but the handshake is not enabled" {
+		t.Fatalf("expected a *HandshakeError, got %v", err)
+	}
+
+	// Only the listener expects a hello, and gets a frame instead.
+	p, q = PipePair()
+	l = Listen(ctx, p, WithHandshake())
+	defer l.Close()
+	if _, err := io.ReadFull(q, make([]byte, helloSize)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := l.Accept(); !errors.As(err, &he) || !errors.Is(err, ErrHandshake) {
+		t.Fatalf("expected a *HandshakeError, got %v", err)
+	}
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	for _, tc := range []struct {
+		version  uint16
+		features Features
+		reason   string
+	}{
+		{2, FeatureMux, "peer speaks version 2, need at least 3"},
+		{3, FeatureChecksums, "peer does not support multiplexing"},
+		{3, FeatureMux | FeatureChecksums, "only one end uses checksums"},
+		{3, FeatureMux | FeatureReliable, "only one end uses reliable delivery"},
+	} {
+		p, q := PipePair()
+		go func() {
+			io.ReadFull(p, make([]byte, helloSize))
+			hello := append(handshakeMagic[:], 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(hello[4:], tc.version)
+			binary.BigEndian.PutUint32(hello[6:], uint32(tc.features))
+			p.Write(hello)
+		}()
+		_, err := Dial(ctx, q, WithHandshake())
+		var he *HandshakeError
+		if !errors.As(err, &he) {
+			t.Fatalf("expected a *HandshakeError, got %v", err)
+		}
+		if he.Reason != tc.reason || he.PeerVersion != tc.version || he.PeerFeatures != tc.features {
+			t.Errorf("unexpected error %+v", he)
+		}
+	}
+}
+
+func TestFeaturesString(t *testing.T) {
+	for f, want := range map[Features]string{
+		0:                             "none",
+		FeatureMux:                    "[mux]",
+		FeatureMux | FeatureChecksums: "[mux checksums]",
+		FeatureReliable:               "[reliable]",
+		FeatureCompression | 1<<8:     "[compression 0x100]",
+	} {
+		if got := f.String(); got != want {
+			t.Errorf("%d: expected %q, got %q", uint32(f), want, got)
+		}
+	}
+}
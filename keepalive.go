@@ -0,0 +1,103 @@
+package stdl
+
+import (
+	"time"
+)
+
+// ErrKeepaliveTimeout is returned by pending and future Read and Write
+// calls once the peer stopped answering keepalive pings. It is a net.Error
+// whose Timeout method reports true.
+var ErrKeepaliveTimeout error = keepaliveTimeoutError{}
+
+type keepaliveTimeoutError struct{}
+
+func (keepaliveTimeoutError) Error() string   { return "keepalive timeout: peer is not responding" }
+func (keepaliveTimeoutError) Timeout() bool   { return true }
+func (keepaliveTimeoutError) Temporary() bool { return false }
+
+// WithKeepalive makes the session that Dial or Listen starts over their
+// transport ping the peer every interval. An interval counts as missed if
+// nothing at all arrived from the peer during it, not even the answer to
+// the ping. After misses missed intervals in a row, the session ends with
+// ErrKeepaliveTimeout, and the function given to WithDisconnectFunc is
+// called. misses is at least 1.
+//
+// The peer answers pings whether or not it enabled keepalive itself. The
+// option has no effect if a session already runs over the transport.
+func WithKeepalive(interval time.Duration, misses int) Option {
+	if misses < 1 {
+		misses = 1
+	}
+	return optionKeepalive{interval, misses}
+}
+
+type optionKeepalive struct {
+	interval time.Duration
+	misses   int
+}
+
+func (optionKeepalive) apply(*conn) error {
+	return nil
+}
+
+func (optionKeepalive) applyListener(*listener) {}
+
+func (opt optionKeepalive) applySession(cfg *sessionConfig) {
+	cfg.keepaliveInterval = opt.interval
+	cfg.keepaliveMisses = opt.misses
+}
+
+// WithDisconnectFunc sets a function that is called with the error of the
+// session that Dial or Listen starts over their transport, when it ends
+// because the peer stopped responding or the transport failed. It is not
+// called when the session is closed locally. With WithResumption, it is
+// called each time the transport is lost and the session is suspended. The
+// option has no effect if a session already runs over the transport.
+func WithDisconnectFunc(f func(err error)) Option {
+	return optionDisconnectFunc(f)
+}
+
+type optionDisconnectFunc func(err error)
+
+func (optionDisconnectFunc) apply(*conn) error {
+	return nil
+}
+
+func (optionDisconnectFunc) applyListener(*listener) {}
+
+func (opt optionDisconnectFunc) applySession(cfg *sessionConfig) {
+	cfg.onDisconnect = opt
+}
+
+// keepalive pings the peer every interval until the session ends, and ends
+// the session once misses intervals in a row went by without a frame from
+// the peer.
+func (s *session) keepalive(interval time.Duration, misses int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	missed := 0
+	for {
+		s.control(header{typ: framePing})
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		if s.alive.Swap(false) {
+			missed = 0
+			continue
+		}
+		missed++
+		s.eventLogger.Debug("missed keepalive", "missed", missed)
+		if missed >= misses {
+			s.eventLogger.Error("peer is not responding", "missed", missed, "interval", interval)
+			s.terminate(ErrKeepaliveTimeout)
+			// Wake up the reader, which may wait on a transport that
+			// never returns.
+			if d, ok := s.transport().(readDeadliner); ok {
+				d.SetReadDeadline(time.Now())
+			}
+			return
+		}
+	}
+}
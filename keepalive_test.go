@@ -0,0 +1,153 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// The listener answers pings without enabling keepalive itself.
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	disconnected := make(chan error, 1)
+	c, err := Dial(ctx, q, WithKeepalive(5*time.Millisecond, 2), WithDisconnectFunc(func(err error) { disconnected <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go io.Copy(s, s)
+
+	// An idle but healthy session stays up.
+	time.Sleep(50 * time.Millisecond)
+	testEcho(t, c)
+	select {
+	case err := <-disconnected:
+		t.Fatalf("unexpected disconnect: %v", err)
+	default:
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// The peer takes the stream, then hangs without reading or writing.
+	p, q := PipePair()
+	defer p.Close()
+	go func() {
+		for {
+			b := make([]byte, headerSize)
+			if _, err := io.ReadFull(p, b); err != nil {
+				return
+			}
+			var h header
+			h.decode(b)
+			if h.typ == frameOpen {
+				return
+			}
+		}
+	}()
+	disconnected := make(chan error, 1)
+	c, err := Dial(ctx, q, WithKeepalive(5*time.Millisecond, 3), WithDisconnectFunc(func(err error) { disconnected <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		errs <- err
+	}()
+	go func() {
+		_, err := c.Write(make([]byte, 1<<20))
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		var ne net.Error
+		if !errors.Is(err, ErrKeepaliveTimeout) || !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("expected a keepalive timeout, got %v", err)
+		}
+	}
+	select {
+	case err := <-disconnected:
+		if err != ErrKeepaliveTimeout {
+			t.Fatalf("expected %v, got %v", ErrKeepaliveTimeout, err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the disconnect function was not called")
+	}
+}
+
+func TestDisconnectFunc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// A lost transport counts as a disconnect.
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	disconnected := make(chan error, 1)
+	c, err := Dial(ctx, q, WithDisconnectFunc(func(err error) { disconnected <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	p.Close()
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	case <-ctx.Done():
+		t.Fatal("the disconnect function was not called")
+	}
+}
+
+func TestKeepaliveBulk(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// Both ends write in bulk over a small buffer, while pings, pongs and
+	// window updates go back and forth. Neither reader may wait for its
+	// writer, which waits for the peer's reader.
+	p, q := BufferedPipePair(64)
+	l := Listen(ctx, p, WithKeepalive(time.Millisecond, 1000))
+	defer l.Close()
+	go echo(l)
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			c, err := Dial(ctx, q, WithKeepalive(time.Millisecond, 1000))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			data := make([]byte, 512<<10)
+			go c.Write(data)
+			_, err = io.ReadFull(c, make([]byte, len(data)))
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
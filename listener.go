@@ -2,87 +2,275 @@ package stdl
 
 import (
 	"context"
-	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
-var eventLogger = log.New(io.Discard, "", 0)
-
 type listener struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	conn     *conn
-	incoming chan net.Conn
+	// connCtx is the parent context of accepted conns. It is not canceled
+	// by Close, so that accepted conns outlive the listener by default.
+	connCtx context.Context
+
+	incoming chan *conn
+	done     chan struct{}
+	once     sync.Once
+
+	mu            sync.Mutex
+	conns         map[*conn]struct{}
+	closeAccepted bool
+
+	stdoutRedirect io.Writer
+	onClose        []func()
+	closed         bool // set once onClose has been taken by Close
+
+	s *session
+
+	// name is the endpoint name that the listener was published under.
+	name string
+
+	readBufferSize int
+	acceptQueue    int
+	window         int
+	connOpts       []DialOption
 
-	pipe io.ReadWriter
+	eventLogger *slog.Logger
+	errorLogger *slog.Logger
+	dump        dumpConfig
+	capture     *captureWriter
 
-	eventLogger *log.Logger
+	id          uint64
+	accepts     atomic.Uint64
+	refused     atomic.Uint64
+	errors      atomic.Uint64
+	connMetrics connMetrics
 }
 
-func Listen(ctx context.Context, p io.ReadWriter) net.Listener {
+// Listen accepts streams that the peer opens over p with Dial. Each stream
+// is returned as a separate net.Conn by Accept.
+func Listen(ctx context.Context, p io.ReadWriter, opts ...ListenOption) net.Listener {
+	return listen(ctx, p, opts...)
+}
+
+func listen(ctx context.Context, p io.ReadWriter, opts ...ListenOption) *listener {
 	l := new(listener)
 	l.ctx, l.cancel = context.WithCancel(ctx)
-	l.incoming = make(chan net.Conn)
-	l.pipe = p
-	l.eventLogger = eventLogger
-	go l.do()
+	l.connCtx = ctx
+	l.done = make(chan struct{})
+	l.conns = make(map[*conn]struct{})
+	l.eventLogger = defaultLogger
+	l.dump = defaultDumpConfig
+	l.readBufferSize = readBufferSize
+	l.acceptQueue = acceptBacklog
+	l.window = defaultWindowSize
+	l.id = listenerIDs.Add(1)
+
+	// Apply ListenOptions.
+	for _, opt := range opts {
+		opt.applyListener(l)
+	}
+	if l.errorLogger == nil {
+		l.errorLogger = l.eventLogger
+	}
+	l.incoming = make(chan *conn, l.acceptQueue)
+
+	cfg := sessionConfig{readBufferSize: l.readBufferSize, eventLogger: l.eventLogger}
+	applySessionOptions(&cfg, opts)
+	l.s = sessionFor(p, false, cfg)
+	l.s.setListener(l)
+	listeners.Lock()
+	listeners.m[l] = struct{}{}
+	listeners.Unlock()
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			l.Close()
+		case <-l.done:
+		}
+	}()
 	return l
 }
 
+// Accept waits for the next stream opened by the peer. Once the listener
+// is closed, pending and future calls return an error wrapping
+// net.ErrClosed.
 func (l *listener) Accept() (net.Conn, error) {
-	c, ok := <-l.incoming
-	if !ok {
-		return nil, errors.New("closed")
+	select {
+	case c := <-l.incoming:
+		l.accepts.Add(1)
+		return c, nil
+	case <-l.done:
+		return nil, l.opError(net.ErrClosed)
+	case <-l.s.done:
+		l.errors.Add(1)
+		return nil, l.opError(l.s.err)
 	}
-	return c, nil
 }
 
-func (l *listener) do() {
-	defer l.Close()
-	buf := make([]byte, 65536)
-	for {
-		n, err := l.pipe.Read(buf)
-		if err != nil {
-			l.eventLogger.Printf("failed to read: %s", err)
-			return
+func (l *listener) opError(err error) error {
+	return &net.OpError{Op: "accept", Net: "io", Addr: l.Addr(), Err: err}
+}
+
+// newConn creates the conn for a stream opened by the peer. The listener
+// keeps track of it until it is closed.
+func (l *listener) newConn(s *session, id uint32) (*conn, error) {
+	var c *conn
+	ctx := context.WithValue(l.connCtx, "disconnect", func(_ context.Context) {
+		l.mu.Lock()
+		delete(l.conns, c)
+		l.mu.Unlock()
+	})
+	c = newConn(ctx, s, id)
+	c.localName = l.name
+	c.eventLogger = l.eventLogger
+	c.errorLogger = l.errorLogger
+	c.dump = l.dump
+	c.capture = l.capture
+	c.window = l.window
+	c.listenerMetrics = &l.connMetrics
+	for _, opt := range l.connOpts {
+		if err := opt.apply(c); err != nil {
+			c.untrack()
+			return nil, err
 		}
-		l.eventLogger.Printf("read %db", n)
-		if l.conn == nil {
-			connCtx := context.WithValue(l.ctx, "disconnect", func(_ context.Context) {
-				l.conn = nil
-			})
-			l.conn, err = newConn(connCtx, l.pipe)
-			if err != nil {
-				l.eventLogger.Printf("failed to initialize connection: %s", err)
-				l.conn = nil
+	}
+	l.mu.Lock()
+	l.conns[c] = struct{}{}
+	l.mu.Unlock()
+	return c, nil
+}
+
+// Close stops accepting streams. Streams that the peer opened but that
+// were not accepted yet are refused. Accepted conns stay open unless the
+// listener was created with WithCloseAccepted. The background reader stops
+// once no conn uses the underlying io.ReadWriter anymore.
+func (l *listener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		err = nil
+		close(l.done)
+		l.cancel()
+		l.s.setListener(nil)
+
+		// Refuse streams that are still waiting for Accept.
+		for {
+			select {
+			case c := <-l.incoming:
+				c.abort()
+				l.refused.Add(1)
 				continue
+			default:
 			}
-			l.incoming <- l.conn
+			break
 		}
-		l.conn.Write(buf[:n])
-	}
+
+		if l.closeAccepted {
+			l.mu.Lock()
+			conns := make([]*conn, 0, len(l.conns))
+			for c := range l.conns {
+				conns = append(conns, c)
+			}
+			l.mu.Unlock()
+			for _, c := range conns {
+				c.Close()
+			}
+		}
+
+		l.s.closeIfIdle()
+
+		listeners.Lock()
+		delete(listeners.m, l)
+		listeners.Unlock()
+
+		l.mu.Lock()
+		onClose := l.onClose
+		l.closed = true
+		l.mu.Unlock()
+		for _, f := range onClose {
+			f()
+		}
+	})
+	return err
 }
 
-func (l *listener) Close() error {
-	defer l.cancel()
-	return nil
+// atClose arranges for f to be called by Close. If l is already closed, f
+// is called right away.
+func (l *listener) atClose(f func()) {
+	l.mu.Lock()
+	if !l.closed {
+		l.onClose = append(l.onClose, f)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	f()
 }
 
 func (l *listener) Addr() net.Addr {
-	return l
+	return Addr{Name: l.name}
+}
+
+// ListenOption configures a listener, and through WithConnOptions the
+// conns it accepts.
+type ListenOption interface {
+	applyListener(*listener)
+}
+
+// WithReadBufferSize sets the size of the buffer that frames are read into
+// from the underlying io.ReadWriter. It defaults to 64 KiB. It has no
+// effect if a Dial already uses the same io.ReadWriter.
+func WithReadBufferSize(n int) ListenOption {
+	return listenOptionReadBufferSize(n)
+}
+
+type listenOptionReadBufferSize int
+
+func (opt listenOptionReadBufferSize) applyListener(l *listener) {
+	if opt > 0 {
+		l.readBufferSize = int(opt)
+	}
 }
 
-func (l *listener) Network() string {
-	return "io"
+// WithAcceptQueue sets how many streams opened by the peer may wait for
+// Accept. Further streams are refused until Accept catches up. It defaults
+// to 16.
+func WithAcceptQueue(n int) ListenOption {
+	return listenOptionAcceptQueue(n)
+}
+
+type listenOptionAcceptQueue int
+
+func (opt listenOptionAcceptQueue) applyListener(l *listener) {
+	if opt >= 0 {
+		l.acceptQueue = int(opt)
+	}
 }
 
-func (l *listener) String() string {
-	return "io"
+// WithConnOptions sets options that are applied to every conn the listener
+// accepts. A stream for which an option fails is refused.
+func WithConnOptions(opts ...DialOption) ListenOption {
+	return listenOptionConnOptions(opts)
+}
+
+type listenOptionConnOptions []DialOption
+
+func (opt listenOptionConnOptions) applyListener(l *listener) {
+	l.connOpts = append(l.connOpts, opt...)
+}
+
+type listenOptionCloseAccepted struct{}
+
+func (listenOptionCloseAccepted) applyListener(l *listener) {
+	l.closeAccepted = true
 }
 
-func SetLogger(logger *log.Logger) {
-	eventLogger = logger
+// WithCloseAccepted makes Close of the listener also close every conn it
+// has accepted.
+func WithCloseAccepted() ListenOption {
+	return listenOptionCloseAccepted{}
 }
@@ -0,0 +1,234 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerCloseAccept(t *testing.T) {
+	p, _ := PipePair()
+	l := Listen(context.Background(), p)
+
+	// A pending Accept is released by Close.
+	res := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		res <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-res:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected %v from pending Accept, got %v", net.ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v from Accept, got %v", net.ErrClosed, err)
+	}
+	if err := l.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v from second Close, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestListenerContextDone(t *testing.T) {
+	p, _ := PipePair()
+	ctx, cancel := context.WithCancel(context.Background())
+	l := Listen(ctx, p)
+	cancel()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestListenerCloseAccepted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	for _, closeAccepted := range []bool{false, true} {
+		p, q := PipePair()
+		var opts []ListenOption
+		if closeAccepted {
+			opts = append(opts, WithCloseAccepted())
+		}
+		l := Listen(ctx, p, opts...)
+		c, err := Dial(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		if closeAccepted {
+			// The client sees the conn being closed.
+			if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("expected io.EOF, got %v", err)
+			}
+			continue
+		}
+		// The accepted conn is still usable.
+		go s.Write([]byte("x"))
+		if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListenerCloseStopsReader(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	l := Listen(context.Background(), r)
+	l.Close()
+
+	// Once the listener is closed, its reader no longer consumes data from
+	// the transport.
+	time.Sleep(10 * time.Millisecond)
+	data := []byte("not for the listener")
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerLoggers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// Each listener logs to its own loggers, and so do the conns it
+	// accepts.
+	var logs [2]strings.Builder
+	var errLogs [2]strings.Builder
+	for i := range logs {
+		p, q := PipePair()
+		l := Listen(ctx, p,
+			WithEventLogger(log.New(&logs[i], "", 0)),
+			WithErrorLogger(log.New(&errLogs[i], "", 0)))
+		defer l.Close()
+		c, err := Dial(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.(*conn).errorLogger.Handler().(*logHandler).l.Writer() != &errLogs[i] {
+			t.Errorf("listener %d: accepted conn has the wrong error logger", i)
+		}
+		fmt.Fprintf(s, "from %d", i)
+		if _, err := io.ReadFull(c, make([]byte, 6)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range logs {
+		if got := logs[i].String(); !strings.Contains(got, "accepted stream") || !strings.Contains(got, fmt.Sprintf("from %d", i)) || strings.Contains(got, fmt.Sprintf("from %d", 1-i)) {
+			t.Errorf("listener %d: unexpected log %q", i, got)
+		}
+	}
+}
+
+func TestListenerAcceptQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, WithAcceptQueue(1), WithReadBufferSize(16))
+	defer l.Close()
+
+	// The first stream waits for Accept, the second one is refused.
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := Dial(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	if _, err := conns[1].Read(make([]byte, 1)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("larger than the read buffer ", 4)
+	go io.WriteString(conns[0], data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+func TestListenerConnOptions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var buf strings.Builder
+	p, q := PipePair()
+	l := Listen(ctx, p, WithConnOptions(WithEventLogger(log.New(&buf, "", 0))))
+	defer l.Close()
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(s, "hello")
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "hello") {
+		t.Fatalf("conn option not applied, log is %q", buf.String())
+	}
+
+	// A stream for which an option fails is refused.
+	p, q = PipePair()
+	failing := WithConnOptions(dialOptionFunc(func(*conn) error { return errors.New("no") }))
+	l = Listen(ctx, p, failing)
+	defer l.Close()
+	c, err = Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+}
+
+type dialOptionFunc func(*conn) error
+
+func (f dialOptionFunc) apply(c *conn) error { return f(c) }
@@ -0,0 +1,257 @@
+package stdl
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// defaultLogger is used by conns and listeners created without a logger.
+var defaultLogger = slog.New(discardHandler{})
+
+// SetDefaultLogger sets the logger of the conns and listeners that are
+// created afterwards without WithLogger, WithEventLogger or
+// WithErrorLogger.
+func SetDefaultLogger(logger *slog.Logger) {
+	defaultLogger = logger
+}
+
+// SetLogger is like SetDefaultLogger for a *log.Logger, which receives
+// records of every level.
+//
+// Deprecated: Use SetDefaultLogger.
+func SetLogger(logger *log.Logger) {
+	defaultLogger = slog.New(newLogHandler(logger))
+}
+
+// WithLogger sets the logger that receives the events and errors of a conn.
+// The data a conn reads and writes is logged at slog.LevelDebug, with a hex
+// dump that is only built if that level is enabled. Given to Listen, the
+// logger receives the events of the listener and its session, and is the
+// logger of the conns the listener accepts.
+func WithLogger(logger *slog.Logger) Option {
+	return optionLogger{logger}
+}
+
+type optionLogger struct {
+	l *slog.Logger
+}
+
+func (opt optionLogger) apply(c *conn) error {
+	c.eventLogger = opt.l
+	c.errorLogger = opt.l
+	return nil
+}
+
+func (opt optionLogger) applyListener(l *listener) {
+	l.eventLogger = opt.l
+	l.errorLogger = opt.l
+}
+
+// WithEventLogger sets a *log.Logger that receives the events of a conn,
+// such as the data it reads and writes, as text. Given to Listen, it
+// receives the events of the listener and its session, and is the event
+// logger of the conns the listener accepts. A logger that writes to
+// io.Discard costs nothing.
+//
+// Deprecated: Use WithLogger, whose handler can filter records by level.
+func WithEventLogger(logger *log.Logger) Option {
+	return optionEventLogger{slog.New(newLogHandler(logger))}
+}
+
+type optionEventLogger struct {
+	l *slog.Logger
+}
+
+func (opt optionEventLogger) apply(c *conn) error {
+	c.eventLogger = opt.l
+	return nil
+}
+
+func (opt optionEventLogger) applyListener(l *listener) {
+	l.eventLogger = opt.l
+}
+
+// WithErrorLogger sets a *log.Logger that receives the errors of a conn as
+// text, as well as what a command or WASM module writes to stderr. Given to
+// Listen, it is the error logger of the conns the listener accepts.
+//
+// Deprecated: Use WithLogger, whose handler can filter records by level.
+func WithErrorLogger(logger *log.Logger) Option {
+	return optionErrorLogger{slog.New(newLogHandler(logger))}
+}
+
+type optionErrorLogger struct {
+	l *slog.Logger
+}
+
+func (opt optionErrorLogger) apply(c *conn) error {
+	c.errorLogger = opt.l
+	return nil
+}
+
+func (opt optionErrorLogger) applyListener(l *listener) {
+	l.errorLogger = opt.l
+}
+
+// errorLoggerOf returns the error logger that opts give a conn.
+func errorLoggerOf(opts []DialOption) *slog.Logger {
+	logger := defaultLogger
+	for _, opt := range opts {
+		switch opt := opt.(type) {
+		case optionLogger:
+			logger = opt.l
+		case optionErrorLogger:
+			logger = opt.l
+		}
+	}
+	return logger
+}
+
+// dumpConfig limits the hex dumps of the data that a conn reads and
+// writes.
+type dumpConfig struct {
+	// limit is the number of bytes dumped per chunk, or -1 for all of them.
+	limit int
+	// every is the number of chunks per direction of which one is dumped.
+	every uint64
+}
+
+var defaultDumpConfig = dumpConfig{limit: -1, every: 1}
+
+// WithDumpLimit truncates the hex dumps of the data a conn reads and writes
+// to the first n bytes of each chunk. With n = 0, only the size of a chunk
+// is logged. Given to Listen, it applies to the conns the listener accepts.
+func WithDumpLimit(n int) Option {
+	return optionDumpLimit(n)
+}
+
+type optionDumpLimit int
+
+func (opt optionDumpLimit) apply(c *conn) error {
+	if opt >= 0 {
+		c.dump.limit = int(opt)
+	}
+	return nil
+}
+
+func (opt optionDumpLimit) applyListener(l *listener) {
+	if opt >= 0 {
+		l.dump.limit = int(opt)
+	}
+}
+
+// WithDumpSampling only dumps one in every n chunks that a conn reads, and
+// likewise of those it writes, starting with the first. The other chunks
+// are logged with their size only. Given to Listen, it applies to the conns
+// the listener accepts.
+func WithDumpSampling(n int) Option {
+	return optionDumpSampling(n)
+}
+
+type optionDumpSampling int
+
+func (opt optionDumpSampling) apply(c *conn) error {
+	if opt > 0 {
+		c.dump.every = uint64(opt)
+	}
+	return nil
+}
+
+func (opt optionDumpSampling) applyListener(l *listener) {
+	if opt > 0 {
+		l.dump.every = uint64(opt)
+	}
+}
+
+// logData logs a chunk of data that c has read or written, numbered n in
+// its direction. Nothing is done unless debug records are enabled.
+func (c *conn) logData(dir string, n uint64, b []byte) {
+	ctx := context.Background()
+	if !c.eventLogger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Uint64("conn", c.cid),
+		slog.String("dir", dir),
+		slog.Int("bytes", len(b)),
+	}
+	if c.dump.limit != 0 && (n-1)%c.dump.every == 0 {
+		d := b
+		if c.dump.limit > 0 && len(d) > c.dump.limit {
+			d = d[:c.dump.limit]
+			attrs = append(attrs, slog.Bool("truncated", true))
+		}
+		attrs = append(attrs, slog.String("dump", hex.Dump(d)))
+	}
+	c.eventLogger.LogAttrs(ctx, slog.LevelDebug, dir, attrs...)
+}
+
+// discardHandler is a slog.Handler that drops every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// logHandler is a slog.Handler that prints records to a *log.Logger, as
+// the message followed by key=value pairs. Values spanning several lines,
+// like hex dumps, are printed after the rest of the record. It backs the
+// deprecated options that take a *log.Logger.
+type logHandler struct {
+	l      *log.Logger
+	prefix string
+	attrs  []slog.Attr
+}
+
+func newLogHandler(l *log.Logger) *logHandler {
+	return &logHandler{l: l}
+}
+
+func (h *logHandler) Enabled(context.Context, slog.Level) bool {
+	return h.l.Writer() != io.Discard
+}
+
+func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
+	var b, blocks strings.Builder
+	b.WriteString(r.Message)
+	add := func(prefix string, a slog.Attr) {
+		v := a.Value.Resolve().String()
+		if strings.Contains(v, "\n") {
+			fmt.Fprintf(&blocks, "\n%s", strings.TrimSuffix(v, "\n"))
+			return
+		}
+		fmt.Fprintf(&b, " %s%s=%s", prefix, a.Key, v)
+	}
+	for _, a := range h.attrs {
+		add("", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(h.prefix, a)
+		return true
+	})
+	b.WriteString(blocks.String())
+	h.l.Print(b.String())
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
@@ -0,0 +1,148 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordHandler keeps the records of the enabled levels.
+type recordHandler struct {
+	level slog.Level
+
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+// data returns the attributes of the records logged for chunks of data.
+func (h *recordHandler) data() []map[string]slog.Value {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var all []map[string]slog.Value
+	for _, r := range h.records {
+		if r.Message != "read" && r.Message != "write" {
+			continue
+		}
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		all = append(all, attrs)
+	}
+	return all
+}
+
+// exchange writes chunks from a new conn over a pipe pair and reads them
+// on the other side.
+func exchange(t *testing.T, chunks []string, opts ...DialOption) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	c, err := Dial(ctx, q, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if _, err := io.WriteString(c, chunk); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(s, make([]byte, len(chunk))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	h := &recordHandler{level: slog.LevelInfo}
+	exchange(t, []string{"hello"}, WithLogger(slog.New(h)))
+	if got := h.data(); len(got) != 0 {
+		t.Fatalf("expected no data records above debug, got %v", got)
+	}
+
+	h = &recordHandler{level: slog.LevelDebug}
+	exchange(t, []string{"hello"}, WithLogger(slog.New(h)))
+	got := h.data()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 data record, got %v", got)
+	}
+	if got[0]["dir"].String() != "write" || got[0]["bytes"].Int64() != 5 || got[0]["conn"].Uint64() == 0 {
+		t.Errorf("unexpected attributes %v", got[0])
+	}
+	if !strings.Contains(got[0]["dump"].String(), "|hello|") {
+		t.Errorf("unexpected dump %q", got[0]["dump"])
+	}
+}
+
+func TestLogDumpLimit(t *testing.T) {
+	h := &recordHandler{level: slog.LevelDebug}
+	exchange(t, []string{"hello world"}, WithLogger(slog.New(h)), WithDumpLimit(5))
+	got := h.data()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 data record, got %v", got)
+	}
+	if got[0]["bytes"].Int64() != 11 || !got[0]["truncated"].Bool() || !strings.Contains(got[0]["dump"].String(), "|hello|") {
+		t.Errorf("unexpected attributes %v", got[0])
+	}
+
+	h = &recordHandler{level: slog.LevelDebug}
+	exchange(t, []string{"hello"}, WithLogger(slog.New(h)), WithDumpLimit(0))
+	if got := h.data(); len(got) != 1 || got[0]["dump"].Kind() != slog.KindAny || got[0]["bytes"].Int64() != 5 {
+		t.Errorf("expected a record without dump, got %v", got)
+	}
+}
+
+func TestLogDumpSampling(t *testing.T) {
+	h := &recordHandler{level: slog.LevelDebug}
+	exchange(t, []string{"a", "b", "c", "d", "e"}, WithLogger(slog.New(h)), WithDumpSampling(2))
+	var dumped []string
+	for _, attrs := range h.data() {
+		if d, ok := attrs["dump"]; ok {
+			dumped = append(dumped, d.String())
+		}
+	}
+	if len(dumped) != 3 || !strings.Contains(dumped[0], "|a|") || !strings.Contains(dumped[1], "|c|") || !strings.Contains(dumped[2], "|e|") {
+		t.Fatalf("expected dumps of chunks a, c and e, got %q", dumped)
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(log.New(&buf, "", 0))).With("conn", 3).WithGroup("g")
+	logger.Debug("wrote", "bytes", 2, "dump", "line 1\nline 2\n")
+	if got, want := buf.String(), "wrote conn=3 g.bytes=2\nline 1\nline 2\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	if newLogHandler(log.New(io.Discard, "", 0)).Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("a logger writing to io.Discard should not be enabled")
+	}
+}
@@ -0,0 +1,313 @@
+package stdl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blockedBuckets are the upper bounds of the buckets of the histograms of
+// the time spent in Read and Write.
+var blockedBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// ConnStats are the counters of a conn, or the totals of several conns.
+// The conns returned by this package have a Stats method:
+//
+//	if sc, ok := c.(interface{ Stats() stdl.ConnStats }); ok {
+//		stats := sc.Stats()
+//	}
+type ConnStats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+	Reads        uint64
+	Writes       uint64
+	// Errors counts the Read and Write calls that failed with an error
+	// other than io.EOF or os.ErrDeadlineExceeded.
+	Errors uint64
+	// ReadBlocked and WriteBlocked are the time spent in Read and Write.
+	ReadBlocked  Histogram
+	WriteBlocked Histogram
+}
+
+// ListenerStats are the counters of a listener.
+type ListenerStats struct {
+	// Accepts is the number of conns returned by Accept.
+	Accepts uint64
+	// Refused is the number of streams opened by the peer that the
+	// listener refused, for example because its accept queue was full.
+	Refused uint64
+	// Errors is the number of Accept calls that failed for another reason
+	// than the listener being closed.
+	Errors uint64
+	// ActiveConns is the number of accepted conns that are not closed yet.
+	ActiveConns int
+	// Conns are the totals of the conns accepted by the listener.
+	Conns ConnStats
+}
+
+// Histogram is a snapshot of a distribution of durations.
+type Histogram struct {
+	// Buckets has a cumulative count per upper bound. The last bucket, with
+	// a negative upper bound, counts all observations.
+	Buckets []Bucket
+	Count   uint64
+	Sum     time.Duration
+}
+
+// Bucket is a bucket of a Histogram.
+type Bucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// histogram records durations in blockedBuckets.
+type histogram struct {
+	counts [len(blockedBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(blockedBuckets), func(i int) bool { return d <= blockedBuckets[i] })
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	var s Histogram
+	s.Buckets = make([]Bucket, len(h.counts))
+	for i := range h.counts {
+		s.Count += h.counts[i].Load()
+		s.Buckets[i] = Bucket{UpperBound: -1, Count: s.Count}
+		if i < len(blockedBuckets) {
+			s.Buckets[i].UpperBound = blockedBuckets[i]
+		}
+	}
+	s.Sum = time.Duration(h.sum.Load())
+	return s
+}
+
+// connMetrics are the counters behind ConnStats.
+type connMetrics struct {
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	reads        atomic.Uint64
+	writes       atomic.Uint64
+	errors       atomic.Uint64
+	readBlocked  histogram
+	writeBlocked histogram
+}
+
+func (m *connMetrics) record(read bool, n int, d time.Duration, err error) {
+	if read {
+		m.reads.Add(1)
+		m.bytesRead.Add(uint64(n))
+		m.readBlocked.observe(d)
+	} else {
+		m.writes.Add(1)
+		m.bytesWritten.Add(uint64(n))
+		m.writeBlocked.observe(d)
+	}
+	if err != nil && err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+		m.errors.Add(1)
+	}
+}
+
+func (m *connMetrics) snapshot() ConnStats {
+	return ConnStats{
+		BytesRead:    m.bytesRead.Load(),
+		BytesWritten: m.bytesWritten.Load(),
+		Reads:        m.reads.Load(),
+		Writes:       m.writes.Load(),
+		Errors:       m.errors.Load(),
+		ReadBlocked:  m.readBlocked.snapshot(),
+		WriteBlocked: m.writeBlocked.snapshot(),
+	}
+}
+
+// totals are the metrics of all conns, and activeConns the number of conns
+// that are not closed yet. A conn that was reset, or whose session ended,
+// no longer counts as active even if it was not closed.
+var (
+	totals      connMetrics
+	activeConns atomic.Int64
+)
+
+// listeners are the open listeners, which MetricsHandler reports on.
+var listeners = struct {
+	sync.Mutex
+	m map[*listener]struct{}
+}{m: make(map[*listener]struct{})}
+
+// listenerIDs hands out the IDs that tell listeners apart in metrics.
+var listenerIDs atomic.Uint64
+
+// Stats returns the counters of c.
+func (c *conn) Stats() ConnStats {
+	return c.metrics.snapshot()
+}
+
+// record counts a Read or Write call of c that took d.
+func (c *conn) record(read bool, n int, d time.Duration, err error) {
+	c.metrics.record(read, n, d, err)
+	totals.record(read, n, d, err)
+	if c.listenerMetrics != nil {
+		c.listenerMetrics.record(read, n, d, err)
+	}
+}
+
+// untrack stops counting c as active.
+func (c *conn) untrack() {
+	if c.untracked.CompareAndSwap(false, true) {
+		activeConns.Add(-1)
+	}
+}
+
+// Stats returns the counters of l and the conns it accepted.
+func (l *listener) Stats() ListenerStats {
+	l.mu.Lock()
+	active := len(l.conns)
+	l.mu.Unlock()
+	return ListenerStats{
+		Accepts:     l.accepts.Load(),
+		Refused:     l.refused.Load(),
+		Errors:      l.errors.Load(),
+		ActiveConns: active,
+		Conns:       l.connMetrics.snapshot(),
+	}
+}
+
+// MetricsHandler returns an http.Handler that renders the totals of all
+// conns, and the counters of every open listener, in the Prometheus text
+// exposition format. The series of a listener are labeled with its name and
+// an ID.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+// labeledStats are the stats of a listener with its labels.
+type labeledStats struct {
+	labels string
+	stats  ListenerStats
+}
+
+func writeMetrics(w io.Writer) {
+	listeners.Lock()
+	ls := make([]*listener, 0, len(listeners.m))
+	for l := range listeners.m {
+		ls = append(ls, l)
+	}
+	listeners.Unlock()
+	sort.Slice(ls, func(i, j int) bool { return ls[i].id < ls[j].id })
+	all := make([]labeledStats, len(ls))
+	for i, l := range ls {
+		all[i] = labeledStats{
+			labels: fmt.Sprintf(`listener="%s",id="%d"`, labelEscaper.Replace(l.name), l.id),
+			stats:  l.Stats(),
+		}
+	}
+
+	writeHeader(w, "stdl_conns_active", "gauge", "Conns that are not closed yet.")
+	fmt.Fprintf(w, "stdl_conns_active %d\n", activeConns.Load())
+	writeConnStats(w, "stdl_conn_", []labeledStats{{stats: ListenerStats{Conns: totals.snapshot()}}})
+
+	if len(all) == 0 {
+		return
+	}
+	for _, m := range []struct {
+		name, typ, help string
+		value           func(ListenerStats) uint64
+	}{
+		{"accepts_total", "counter", "Conns returned by Accept.", func(s ListenerStats) uint64 { return s.Accepts }},
+		{"refused_total", "counter", "Streams refused by the listener.", func(s ListenerStats) uint64 { return s.Refused }},
+		{"errors_total", "counter", "Failed Accept calls.", func(s ListenerStats) uint64 { return s.Errors }},
+		{"conns_active", "gauge", "Accepted conns that are not closed yet.", func(s ListenerStats) uint64 { return uint64(s.ActiveConns) }},
+	} {
+		name := "stdl_listener_" + m.name
+		writeHeader(w, name, m.typ, m.help)
+		for _, ls := range all {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, ls.labels, m.value(ls.stats))
+		}
+	}
+	writeConnStats(w, "stdl_listener_conn_", all)
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeConnStats writes the metric families of the conn stats in all,
+// with names starting with prefix.
+func writeConnStats(w io.Writer, prefix string, all []labeledStats) {
+	for _, m := range []struct {
+		name, help string
+		value      func(ConnStats) uint64
+	}{
+		{"read_bytes_total", "Bytes read.", func(s ConnStats) uint64 { return s.BytesRead }},
+		{"written_bytes_total", "Bytes written.", func(s ConnStats) uint64 { return s.BytesWritten }},
+		{"reads_total", "Read calls.", func(s ConnStats) uint64 { return s.Reads }},
+		{"writes_total", "Write calls.", func(s ConnStats) uint64 { return s.Writes }},
+		{"errors_total", "Failed Read and Write calls.", func(s ConnStats) uint64 { return s.Errors }},
+	} {
+		name := prefix + m.name
+		writeHeader(w, name, "counter", m.help)
+		for _, ls := range all {
+			fmt.Fprintf(w, "%s%s %d\n", name, braces(ls.labels), m.value(ls.stats.Conns))
+		}
+	}
+	for _, m := range []struct {
+		name, help string
+		value      func(ConnStats) Histogram
+	}{
+		{"read_blocked_seconds", "Time spent in Read.", func(s ConnStats) Histogram { return s.ReadBlocked }},
+		{"write_blocked_seconds", "Time spent in Write.", func(s ConnStats) Histogram { return s.WriteBlocked }},
+	} {
+		name := prefix + m.name
+		writeHeader(w, name, "histogram", m.help)
+		for _, ls := range all {
+			h := m.value(ls.stats.Conns)
+			sep := ""
+			if ls.labels != "" {
+				sep = ","
+			}
+			for _, b := range h.Buckets {
+				le := "+Inf"
+				if b.UpperBound >= 0 {
+					le = fmt.Sprint(b.UpperBound.Seconds())
+				}
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, ls.labels, sep, le, b.Count)
+			}
+			fmt.Fprintf(w, "%s_sum%s %g\n", name, braces(ls.labels), h.Sum.Seconds())
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(ls.labels), h.Count)
+		}
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
@@ -0,0 +1,182 @@
+package stdl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, listenOptionName("stats"))
+	defer l.Close()
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunk := range []string{"hello", " world"} {
+		if _, err := io.WriteString(c, chunk); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(s, make([]byte, len(chunk))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	s.Write([]byte("x"))
+	s.Close()
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Fatal("Write succeeded after Close")
+	}
+
+	cs := c.(*conn).Stats()
+	if cs.BytesWritten != 11 || cs.Writes != 2 || cs.Reads != 0 || cs.Errors != 0 {
+		t.Errorf("unexpected dialed conn stats %+v", cs)
+	}
+	if cs.WriteBlocked.Count != 2 || cs.WriteBlocked.Buckets[len(cs.WriteBlocked.Buckets)-1].Count != 2 {
+		t.Errorf("unexpected write histogram %+v", cs.WriteBlocked)
+	}
+	ss := s.(*conn).Stats()
+	if ss.BytesRead != 11 || ss.Reads < 3 || ss.Writes != 2 || ss.Errors != 1 {
+		t.Errorf("unexpected accepted conn stats %+v", ss)
+	}
+
+	ls := l.(*listener).Stats()
+	if ls.Accepts != 1 || ls.Conns.BytesRead != 11 || ls.Conns.Errors != 1 {
+		t.Errorf("unexpected listener stats %+v", ls)
+	}
+	// The accepted conn is forgotten asynchronously.
+	for l.(*listener).Stats().ActiveConns != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListenerStatsRefused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, WithAcceptQueue(0))
+	defer l.Close()
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+	if ls := l.(*listener).Stats(); ls.Refused != 1 || ls.Accepts != 0 || ls.ActiveConns != 0 {
+		t.Errorf("unexpected listener stats %+v", ls)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, listenOptionName(`we"b`))
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	io.WriteString(c, "hello")
+	io.ReadFull(s, make([]byte, 5))
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+	labels := fmt.Sprintf(`listener="we\"b",id="%d"`, l.(*listener).id)
+	for _, want := range []string{
+		"# TYPE stdl_conns_active gauge\n",
+		"# TYPE stdl_conn_read_bytes_total counter\n",
+		"# TYPE stdl_conn_read_blocked_seconds histogram\n",
+		"stdl_conn_read_blocked_seconds_bucket{le=\"+Inf\"} ",
+		"stdl_listener_accepts_total{" + labels,
+		"stdl_listener_conn_read_bytes_total{" + labels,
+		"stdl_listener_conn_write_blocked_seconds_bucket{" + labels,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+
+	// Closed listeners are no longer reported.
+	l.Close()
+	rec = httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), `listener="we\"b"`) {
+		t.Errorf("closed listener still reported")
+	}
+}
+
+func TestActiveConnsUntracked(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// A Dial whose open frame gets stuck leaves no active conn behind.
+	p, q := PipePair()
+	before := activeConns.Load()
+	dialCtx, dialCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer dialCancel()
+	if _, err := Dial(dialCtx, q); err != ErrContextCanceled {
+		t.Fatalf("expected %v, got %v", ErrContextCanceled, err)
+	}
+	if n := activeConns.Load(); n > before {
+		t.Errorf("expected at most %d active conns, got %d", before, n)
+	}
+	p.Close()
+
+	// Neither does a conn that the peer resets, or whose session ends,
+	// even if it is never closed.
+	p, q = PipePair()
+	l := Listen(ctx, p, WithAcceptQueue(0))
+	defer l.Close()
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+	if !c.(*conn).untracked.Load() {
+		t.Error("reset conn still counts as active")
+	}
+	c, err = Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !c.(*conn).untracked.Load() {
+		t.Error("conn of an ended session still counts as active")
+	}
+}
@@ -2,6 +2,9 @@ package stdl
 
 import (
 	"io"
+	"os"
+	"sync"
+	"time"
 )
 
 type pipe struct {
@@ -10,6 +13,8 @@ type pipe struct {
 	w io.Writer
 }
 
+// Pipe returns a loopback io.ReadWriter: whatever is written to it can be
+// read back from it. Use PipePair to connect two distinct endpoints.
 func Pipe() io.ReadWriter {
 	p := new(pipe)
 	p.r, p.w = io.Pipe()
@@ -23,3 +28,177 @@ func (p *pipe) Read(b []byte) (int, error) {
 func (p *pipe) Write(b []byte) (int, error) {
 	return p.w.Write(b)
 }
+
+// PipePair returns the two ends of a synchronous, full duplex, in-memory
+// connection, similar to net.Pipe. Whatever is written to one end can be
+// read from the other one, and a Write blocks until the peer has read all
+// of its data. Closing one end makes Read on the other end return io.EOF.
+//
+// Both ends support SetDeadline, SetReadDeadline and SetWriteDeadline.
+func PipePair() (io.ReadWriteCloser, io.ReadWriteCloser) {
+	return BufferedPipePair(0)
+}
+
+// BufferedPipePair is like PipePair, but each direction buffers up to size
+// bytes, so that a Write only blocks once the buffer is full.
+func BufferedPipePair(size int) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	a, b := newHalfPipe(size), newHalfPipe(size)
+	return newPipeEnd(a, b), newPipeEnd(b, a)
+}
+
+// halfPipe carries data in one direction of a pipe pair.
+type halfPipe struct {
+	mu       sync.Mutex
+	buf      []byte
+	size     int
+	rclosed  bool
+	wclosed  bool
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newHalfPipe(size int) *halfPipe {
+	return &halfPipe{
+		size:     size,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (h *halfPipe) read(b []byte, deadline *deadline) (int, error) {
+	for {
+		h.mu.Lock()
+		switch {
+		case h.rclosed:
+			h.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		case len(h.buf) > 0:
+			n := copy(b, h.buf)
+			h.buf = h.buf[n:]
+			h.mu.Unlock()
+			signal(h.writable)
+			return n, nil
+		case h.wclosed:
+			h.mu.Unlock()
+			return 0, io.EOF
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-h.readable:
+		case <-deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (h *halfPipe) write(b []byte, deadline *deadline) (n int, err error) {
+	for {
+		h.mu.Lock()
+		switch {
+		case h.wclosed || h.rclosed:
+			h.mu.Unlock()
+			return n, io.ErrClosedPipe
+		case n == len(b) && (h.size > 0 || len(h.buf) == 0):
+			// Unbuffered writes return once the peer has read everything.
+			h.mu.Unlock()
+			return n, nil
+		case n < len(b):
+			space := h.size - len(h.buf)
+			if h.size == 0 {
+				space = len(b) - n
+			}
+			if space > 0 {
+				if space > len(b)-n {
+					space = len(b) - n
+				}
+				h.buf = append(h.buf, b[n:n+space]...)
+				n += space
+				h.mu.Unlock()
+				signal(h.readable)
+				continue
+			}
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-h.writable:
+		case <-deadline.wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (h *halfPipe) closeRead() {
+	h.mu.Lock()
+	h.rclosed = true
+	h.buf = nil
+	h.mu.Unlock()
+	signal(h.writable)
+	signal(h.readable)
+}
+
+func (h *halfPipe) closeWrite() {
+	h.mu.Lock()
+	h.wclosed = true
+	h.mu.Unlock()
+	signal(h.readable)
+	signal(h.writable)
+}
+
+// pipeEnd is one end of a pipe pair.
+type pipeEnd struct {
+	r *halfPipe
+	w *halfPipe
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+func newPipeEnd(r, w *halfPipe) *pipeEnd {
+	p := new(pipeEnd)
+	p.r = r
+	p.w = w
+	p.readDeadline = newDeadline()
+	p.writeDeadline = newDeadline()
+	return p
+}
+
+func (p *pipeEnd) Read(b []byte) (int, error) {
+	return p.r.read(b, p.readDeadline)
+}
+
+func (p *pipeEnd) Write(b []byte) (int, error) {
+	return p.w.write(b, p.writeDeadline)
+}
+
+// Close closes both directions. The peer reads io.EOF once it has consumed
+// the buffered data, and its writes fail with io.ErrClosedPipe.
+func (p *pipeEnd) Close() error {
+	p.r.closeRead()
+	p.w.closeWrite()
+	return nil
+}
+
+func (p *pipeEnd) SetDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	p.writeDeadline.set(t)
+	return nil
+}
+
+func (p *pipeEnd) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+func (p *pipeEnd) SetWriteDeadline(t time.Time) error {
+	p.writeDeadline.set(t)
+	return nil
+}
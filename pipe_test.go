@@ -0,0 +1,89 @@
+package stdl
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipePair(t *testing.T) {
+	a, b := PipePair()
+
+	// Data written to one end arrives at the other end, in both directions.
+	for _, ends := range [][2]io.ReadWriter{{a, b}, {b, a}} {
+		go ends[0].Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(ends[1], got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "ping" {
+			t.Fatalf("expected %q, got %q", "ping", got)
+		}
+	}
+
+	// An end never reads its own writes.
+	go a.Write([]byte("x"))
+	a.(interface{ SetReadDeadline(time.Time) error }).SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+	b.Read(make([]byte, 1))
+}
+
+func TestPipePairUnbuffered(t *testing.T) {
+	a, b := PipePair()
+
+	// A Write blocks until the peer has read all of its data.
+	done := make(chan struct{})
+	go func() {
+		a.Write([]byte("abc"))
+		close(done)
+	}()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("Write returned before all data was read")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Read(buf)
+	<-done
+}
+
+func TestBufferedPipePair(t *testing.T) {
+	a, b := BufferedPipePair(4)
+	a.(interface{ SetWriteDeadline(time.Time) error }).SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+
+	// Writes up to the buffer size do not block, further ones do.
+	if n, err := a.Write([]byte("abcdef")); n != 4 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected 4 bytes and %v, got %d and %v", os.ErrDeadlineExceeded, n, err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcd" {
+		t.Fatalf("expected %q, got %q", "abcd", got)
+	}
+}
+
+func TestPipePairClose(t *testing.T) {
+	a, b := BufferedPipePair(16)
+	a.Write([]byte("last"))
+	a.Close()
+
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "last" {
+		t.Fatalf("expected %q, got %q", "last", got)
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("expected %v, got %v", io.ErrClosedPipe, err)
+	}
+}
@@ -0,0 +1,277 @@
+//go:build !wasip1
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aksial/stdl"
+	"github.com/tetratelabs/wazero"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// ClientConfig configures the host side of a plugin.
+type ClientConfig struct {
+	HandshakeConfig
+
+	// Plugins are the plugins the host can dispense under
+	// HandshakeConfig.ProtocolVersion.
+	Plugins PluginSet
+
+	// VersionedPlugins lists the plugins per protocol version. If set, it
+	// takes precedence over Plugins.
+	VersionedPlugins map[int]PluginSet
+
+	// Cmd is the plugin binary to run. Either Cmd or Module must be set.
+	Cmd *exec.Cmd
+
+	// Module is a WASM plugin, which is run by Runtime. The runtime must
+	// have WASI instantiated.
+	Module  []byte
+	Runtime wazero.Runtime
+
+	// Logger receives the plugin's stderr, crash reports and the errors of
+	// its conns. Nothing is logged if it is nil.
+	Logger *slog.Logger
+
+	// StartTimeout bounds the time to start the plugin and complete the
+	// handshake. It defaults to one minute.
+	StartTimeout time.Duration
+
+	// GRPCDialOptions are passed on to grpc.NewClient.
+	GRPCDialOptions []grpc.DialOption
+}
+
+// CrashError reports that a plugin went away while the host still used it.
+type CrashError struct {
+	// Err is the reason, for example the *exec.ExitError of the process.
+	Err error
+}
+
+func (e *CrashError) Error() string {
+	return fmt.Sprintf("plugin crashed: %s", e.Err)
+}
+
+func (e *CrashError) Unwrap() error {
+	return e.Err
+}
+
+// Client is the host side of a running plugin.
+type Client struct {
+	cfg     *ClientConfig
+	logger  *slog.Logger
+	ctrl    net.Conn
+	cc      *grpc.ClientConn
+	version int
+	plugins PluginSet
+
+	mu      sync.Mutex
+	closing bool
+	err     error
+	exited  chan struct{}
+}
+
+// NewClient starts the plugin described by cfg, checks the handshake and
+// connects to it with gRPC. The plugin is stopped once ctx is done.
+func NewClient(ctx context.Context, cfg *ClientConfig) (*Client, error) {
+	c := &Client{cfg: cfg, exited: make(chan struct{})}
+	c.logger = cfg.Logger
+	if c.logger == nil {
+		c.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	vp := cfg.VersionedPlugins
+	if len(vp) == 0 {
+		vp = map[int]PluginSet{cfg.ProtocolVersion: cfg.Plugins}
+	}
+	vs := versions(cfg.HandshakeConfig, vp)
+	sort.Ints(vs)
+	env := []string{
+		cfg.MagicCookieKey + "=" + cfg.MagicCookieValue,
+		EnvProtocolVersions + "=" + joinInts(vs),
+	}
+
+	timeout := cfg.StartTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	startCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case cfg.Cmd != nil:
+		c.ctrl, err = c.startCommand(ctx, env)
+	case cfg.Module != nil && cfg.Runtime != nil:
+		c.ctrl, err = c.startModule(ctx, env)
+	default:
+		err = errors.New("either Cmd or Module and Runtime must be set")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := c.handshake(startCtx)
+	if err != nil {
+		c.ctrl.Close()
+		return nil, err
+	}
+	if h.core != CoreProtocolVersion {
+		c.ctrl.Close()
+		return nil, fmt.Errorf("incompatible core protocol version %d, expected %d", h.core, CoreProtocolVersion)
+	}
+	plugins, ok := vp[h.version]
+	if !ok {
+		c.ctrl.Close()
+		return nil, fmt.Errorf("plugin chose unsupported protocol version %d", h.version)
+	}
+	c.version = h.version
+	c.plugins = plugins
+	go c.watch()
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(stdl.GRPCDialer(ctx, c.ctrl.(stdl.Opener))),
+		grpc.WithChainUnaryInterceptor(c.crashInterceptor),
+	}
+	c.cc, err = grpc.NewClient("passthrough:///plugin", append(opts, cfg.GRPCDialOptions...)...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) startCommand(ctx context.Context, env []string) (net.Conn, error) {
+	cmd := c.cfg.Cmd
+	if cmd.Env == nil {
+		cmd.Env = cmd.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
+	return stdl.DialCommand(ctx, cmd, stdl.WithLogger(c.logger))
+}
+
+func (c *Client) startModule(ctx context.Context, env []string) (net.Conn, error) {
+	mc := wazero.NewModuleConfig()
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		mc = mc.WithEnv(k, v)
+	}
+	return stdl.DialWASM(ctx, c.cfg.Runtime, c.cfg.Module, stdl.WithModuleConfig(mc), stdl.WithLogger(c.logger))
+}
+
+// handshake reads the handshake line from the control stream.
+func (c *Client) handshake(ctx context.Context) (handshake, error) {
+	if d, ok := ctx.Deadline(); ok {
+		c.ctrl.SetReadDeadline(d)
+		defer c.ctrl.SetReadDeadline(time.Time{})
+	}
+	// Read byte by byte, so that nothing after the line is consumed.
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := c.ctrl.Read(b); err != nil {
+			return handshake{}, fmt.Errorf("plugin handshake failed: %w", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return parseHandshake(string(line))
+}
+
+// watch waits for the control stream to end, which happens when the plugin
+// exits or when the client is closed.
+func (c *Client) watch() {
+	_, err := io.Copy(io.Discard, bufio.NewReader(c.ctrl))
+
+	c.mu.Lock()
+	if !c.closing {
+		if err == nil {
+			err = errors.New("plugin exited unexpectedly")
+		}
+		c.err = &CrashError{Err: err}
+		c.logger.Error("plugin crashed", "err", err)
+	}
+	c.mu.Unlock()
+	close(c.exited)
+}
+
+// crashInterceptor replaces the errors of calls that failed because the
+// plugin crashed with the reason of the crash.
+func (c *Client) crashInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil && status.Code(err) == codes.Unavailable {
+		if crash := c.Err(); crash != nil {
+			return status.Error(codes.Unavailable, crash.Error())
+		}
+	}
+	return err
+}
+
+// Dispense returns the host side implementation of the plugin called name.
+func (c *Client) Dispense(ctx context.Context, name string) (interface{}, error) {
+	p, ok := c.plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin %q for protocol version %d", name, c.version)
+	}
+	return p.GRPCClient(ctx, c.cc)
+}
+
+// Conn returns the gRPC connection to the plugin.
+func (c *Client) Conn() *grpc.ClientConn {
+	return c.cc
+}
+
+// ProtocolVersion returns the negotiated protocol version.
+func (c *Client) ProtocolVersion() int {
+	return c.version
+}
+
+// Exited is closed once the plugin has gone away.
+func (c *Client) Exited() <-chan struct{} {
+	return c.exited
+}
+
+// Err returns a *CrashError if the plugin went away before the client was
+// closed.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close disconnects from the plugin and stops it.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	if c.cc != nil {
+		c.cc.Close()
+	}
+	return c.ctrl.Close()
+}
+
+func joinInts(vs []int) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
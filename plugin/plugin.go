@@ -0,0 +1,101 @@
+// Package plugin runs plugins on top of stdl, in the spirit of
+// hashicorp/go-plugin.
+//
+// The host launches the plugin as a child process or as a WASM module and
+// talks gRPC to it over the plugin's stdio. Before any gRPC traffic, both
+// sides agree on a magic cookie, which keeps plugin binaries from being run
+// by accident, and on a protocol version, which lets host and plugin evolve
+// their interfaces independently.
+//
+// On the wire, the host opens a control stream first. The plugin answers on
+// it with a single handshake line and keeps it open for as long as it runs.
+// Every gRPC connection is another stream over the same stdio.
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// CoreProtocolVersion is the version of the handshake itself. It changes
+// only if the way host and plugin talk to each other changes.
+const CoreProtocolVersion = 1
+
+// EnvProtocolVersions is the environment variable in which the host passes
+// the protocol versions it supports to the plugin, as a comma separated
+// list.
+const EnvProtocolVersions = "STDL_PLUGIN_PROTOCOL_VERSIONS"
+
+// ErrNotPlugin is reported by a plugin that was run without the magic
+// cookie, which usually means that someone started it by hand.
+var ErrNotPlugin = errors.New("this binary is a plugin and is not meant to be executed directly")
+
+// HandshakeConfig is shared by host and plugin. Both must use the same magic
+// cookie.
+type HandshakeConfig struct {
+	// ProtocolVersion is used when no VersionedPlugins are configured.
+	ProtocolVersion int
+
+	// MagicCookieKey and MagicCookieValue are passed to the plugin as an
+	// environment variable. The plugin refuses to run without it.
+	MagicCookieKey   string
+	MagicCookieValue string
+}
+
+// Plugin is a single interface that a plugin provides.
+type Plugin interface {
+	// GRPCServer registers the implementation of the plugin on s. It is
+	// called on the plugin side.
+	GRPCServer(s *grpc.Server) error
+
+	// GRPCClient returns the implementation that the host uses to talk to
+	// the plugin, usually a gRPC client wrapped in an interface. It is
+	// called on the host side.
+	GRPCClient(ctx context.Context, cc *grpc.ClientConn) (interface{}, error)
+}
+
+// PluginSet is the set of plugins available under one protocol version,
+// keyed by name.
+type PluginSet map[string]Plugin
+
+// versions returns the protocol versions of vp, or just the version of the
+// handshake config if vp is empty.
+func versions(h HandshakeConfig, vp map[int]PluginSet) []int {
+	if len(vp) == 0 {
+		return []int{h.ProtocolVersion}
+	}
+	vs := make([]int, 0, len(vp))
+	for v := range vp {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// handshake is the line the plugin writes on the control stream.
+type handshake struct {
+	core    int
+	version int
+}
+
+func (h handshake) String() string {
+	return fmt.Sprintf("%d|%d\n", h.core, h.version)
+}
+
+func parseHandshake(line string) (h handshake, err error) {
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 2 {
+		return h, fmt.Errorf("malformed handshake %q", line)
+	}
+	if h.core, err = strconv.Atoi(parts[0]); err != nil {
+		return h, fmt.Errorf("malformed core protocol version in handshake %q", line)
+	}
+	if h.version, err = strconv.Atoi(parts[1]); err != nil {
+		return h, fmt.Errorf("malformed protocol version in handshake %q", line)
+	}
+	return h, nil
+}
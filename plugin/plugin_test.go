@@ -0,0 +1,206 @@
+//go:build !wasip1
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aksial/stdl/testdata/grpc/arithmetic/arithmetic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testHandshake = HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "STDL_PLUGIN_TEST_COOKIE",
+	MagicCookieValue: "arithmetic",
+}
+
+type arithmeticServer struct {
+	arithmetic.UnimplementedArithmeticServer
+	crash bool
+}
+
+func (s *arithmeticServer) Add(_ context.Context, in *arithmetic.Many) (*arithmetic.One, error) {
+	var sum float64
+	for _, v := range in.Values {
+		sum += v
+	}
+	return &arithmetic.One{Value: sum}, nil
+}
+
+func (s *arithmeticServer) Div(_ context.Context, in *arithmetic.Many) (*arithmetic.One, error) {
+	if s.crash {
+		os.Exit(2)
+	}
+	if len(in.Values) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "nothing to divide")
+	}
+	v := in.Values[0]
+	for _, d := range in.Values[1:] {
+		if d == 0 {
+			return nil, status.Error(codes.InvalidArgument, "division by zero")
+		}
+		v /= d
+	}
+	return &arithmetic.One{Value: v}, nil
+}
+
+type arithmeticPlugin struct {
+	crash bool
+}
+
+func (p arithmeticPlugin) GRPCServer(s *grpc.Server) error {
+	arithmetic.RegisterArithmeticServer(s, &arithmeticServer{crash: p.crash})
+	return nil
+}
+
+func (arithmeticPlugin) GRPCClient(_ context.Context, cc *grpc.ClientConn) (interface{}, error) {
+	return arithmetic.NewArithmeticClient(cc), nil
+}
+
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("STDL_PLUGIN_HELPER")
+	if mode == "" {
+		return
+	}
+	ServeMain(&ServeConfig{
+		HandshakeConfig: testHandshake,
+		VersionedPlugins: map[int]PluginSet{
+			1: {"arithmetic": arithmeticPlugin{}},
+			2: {"arithmetic": arithmeticPlugin{crash: mode == "crash"}},
+		},
+	})
+	os.Exit(0)
+}
+
+func helperCommand(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "STDL_PLUGIN_HELPER="+mode)
+	return cmd
+}
+
+func newTestClient(t *testing.T, ctx context.Context, mode string, versions ...int) *Client {
+	vp := make(map[int]PluginSet)
+	for _, v := range versions {
+		vp[v] = PluginSet{"arithmetic": arithmeticPlugin{}}
+	}
+	c, err := NewClient(ctx, &ClientConfig{
+		HandshakeConfig:  testHandshake,
+		VersionedPlugins: vp,
+		Cmd:              helperCommand(mode),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func dispense(t *testing.T, ctx context.Context, c *Client) arithmetic.ArithmeticClient {
+	raw, err := c.Dispense(ctx, "arithmetic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw.(arithmetic.ArithmeticClient)
+}
+
+func TestPlugin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c := newTestClient(t, ctx, "serve", 1, 2)
+	if v := c.ProtocolVersion(); v != 2 {
+		t.Fatalf("expected protocol version 2, got %d", v)
+	}
+	a := dispense(t, ctx, c)
+
+	res, err := a.Add(ctx, &arithmetic.Many{Values: []float64{1, 2, 3.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value != 6.5 {
+		t.Fatalf("expected 6.5, got %v", res.Value)
+	}
+	_, err = a.Div(ctx, &arithmetic.Many{Values: []float64{1, 0}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected %v, got %v", codes.InvalidArgument, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-c.Exited()
+	if err := c.Err(); err != nil {
+		t.Fatalf("unexpected error after Close: %v", err)
+	}
+}
+
+func TestPluginVersion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c := newTestClient(t, ctx, "serve", 1)
+	if v := c.ProtocolVersion(); v != 1 {
+		t.Fatalf("expected protocol version 1, got %d", v)
+	}
+
+	_, err := NewClient(ctx, &ClientConfig{
+		HandshakeConfig:  testHandshake,
+		VersionedPlugins: map[int]PluginSet{3: {}},
+		Cmd:              helperCommand("serve"),
+	})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected the plugin to exit, got %v", err)
+	}
+}
+
+func TestPluginCookie(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	h := testHandshake
+	h.MagicCookieValue = "wrong"
+	_, err := NewClient(ctx, &ClientConfig{
+		HandshakeConfig: h,
+		Plugins:         PluginSet{"arithmetic": arithmeticPlugin{}},
+		Cmd:             helperCommand("serve"),
+	})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected the plugin to exit with status 1, got %v", err)
+	}
+}
+
+func TestPluginCrash(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c := newTestClient(t, ctx, "crash", 2)
+	a := dispense(t, ctx, c)
+	_, err := a.Div(ctx, &arithmetic.Many{Values: []float64{1, 2}})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected %v, got %v", codes.Unavailable, err)
+	}
+	<-c.Exited()
+
+	var crash *CrashError
+	if !errors.As(c.Err(), &crash) {
+		t.Fatalf("expected a crash, got %v", c.Err())
+	}
+	if !strings.Contains(crash.Error(), "exit status 2") {
+		t.Fatalf("crash does not mention the exit status: %v", crash)
+	}
+	// Further calls report the crash.
+	_, err = a.Add(ctx, &arithmetic.Many{})
+	if !strings.Contains(status.Convert(err).Message(), "plugin crashed") {
+		t.Fatalf("expected the crash to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aksial/stdl"
+	"google.golang.org/grpc"
+)
+
+// ServeConfig configures the plugin side.
+type ServeConfig struct {
+	HandshakeConfig
+
+	// Plugins are served under HandshakeConfig.ProtocolVersion.
+	Plugins PluginSet
+
+	// VersionedPlugins lists the plugins per protocol version. If set, it
+	// takes precedence over Plugins, and the highest version that the host
+	// supports as well is served.
+	VersionedPlugins map[int]PluginSet
+
+	// GRPCServer creates the gRPC server. It defaults to grpc.NewServer.
+	GRPCServer func(...grpc.ServerOption) *grpc.Server
+}
+
+// ServeMain serves the plugins of cfg on stdio until the host goes away.
+// It is meant to be called from the main function of the plugin. If the
+// plugin cannot be served, the reason is written to stderr and the process
+// exits with status 1.
+func ServeMain(cfg *ServeConfig) {
+	if err := serve(context.Background(), cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func serve(ctx context.Context, cfg *ServeConfig) error {
+	if cfg.MagicCookieKey == "" || os.Getenv(cfg.MagicCookieKey) != cfg.MagicCookieValue {
+		return ErrNotPlugin
+	}
+
+	vp := cfg.VersionedPlugins
+	if len(vp) == 0 {
+		vp = map[int]PluginSet{cfg.ProtocolVersion: cfg.Plugins}
+	}
+	version, err := negotiate(os.Getenv(EnvProtocolVersions), versions(cfg.HandshakeConfig, vp))
+	if err != nil {
+		return err
+	}
+
+	l := stdl.ListenStdio(ctx)
+	defer l.Close()
+
+	// The first stream is the control stream.
+	ctrl, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	newServer := cfg.GRPCServer
+	if newServer == nil {
+		newServer = grpc.NewServer
+	}
+	s := newServer()
+	for name, p := range vp[version] {
+		if err := p.GRPCServer(s); err != nil {
+			return fmt.Errorf("failed to register plugin %q: %w", name, err)
+		}
+	}
+	go s.Serve(l)
+	defer s.Stop()
+
+	if _, err := io.WriteString(ctrl, handshake{CoreProtocolVersion, version}.String()); err != nil {
+		return err
+	}
+
+	// The host closes the control stream when it is done with the plugin.
+	io.Copy(io.Discard, ctrl)
+	return nil
+}
+
+// negotiate picks the highest of the plugin's versions that is listed in
+// hostVersions.
+func negotiate(hostVersions string, ours []int) (int, error) {
+	best := -1
+	for _, s := range strings.Split(hostVersions, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		for _, o := range ours {
+			if o == v && v > best {
+				best = v
+			}
+		}
+	}
+	if best < 0 {
+		return 0, fmt.Errorf("no common protocol version: host supports %q, plugin supports %v", hostVersions, ours)
+	}
+	return best, nil
+}
@@ -0,0 +1,322 @@
+//go:build !wasip1
+
+package stdl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// restartDelay is how long a WASMPool waits before it tries again to
+// replace an instance that could not be started.
+const restartDelay = time.Second
+
+// Balancer decides which instance of a WASMPool a new conn goes to.
+type Balancer int
+
+const (
+	// RoundRobin hands out the instances in turn.
+	RoundRobin Balancer = iota
+
+	// LeastBusy picks the instance with the fewest open conns.
+	LeastBusy
+)
+
+// PoolOption configures a WASMPool.
+type PoolOption interface {
+	applyPool(*WASMPool)
+}
+
+// WithBalancer sets how a WASMPool spreads conns over its instances. The
+// default is RoundRobin.
+func WithBalancer(b Balancer) PoolOption {
+	return poolOptionBalancer(b)
+}
+
+type poolOptionBalancer Balancer
+
+func (opt poolOptionBalancer) applyPool(p *WASMPool) {
+	p.balancer = Balancer(opt)
+}
+
+// WithInstanceOptions sets the options every instance of a WASMPool is
+// dialed with, as if by DialWASM. The error logger also receives a line
+// whenever an instance is replaced.
+func WithInstanceOptions(opts ...DialOption) PoolOption {
+	return poolOptionInstance(opts)
+}
+
+type poolOptionInstance []DialOption
+
+func (opt poolOptionInstance) applyPool(p *WASMPool) {
+	p.opts = append(p.opts, opt...)
+}
+
+// WithCompilationCache sets the cache that a WASMPool created without a
+// runtime compiles the module into, so that pools in this or, with a cache
+// in a directory, other processes reuse the compiled code. The pool does
+// not close the cache.
+func WithCompilationCache(cache wazero.CompilationCache) PoolOption {
+	return poolOptionCache{cache}
+}
+
+type poolOptionCache struct {
+	cache wazero.CompilationCache
+}
+
+func (opt poolOptionCache) applyPool(p *WASMPool) {
+	p.cache = opt.cache
+}
+
+// WASMPool runs several instances of the same WASM module, each serving a
+// Listener on its stdio as with DialWASM, and spreads the conns dialed
+// through it over them. An instance only sees the conns dialed to it. An instance that exits or traps is replaced by a new one.
+//
+// The module is compiled once for all instances. To also reuse the
+// compiled code across pools, give NewWASMPool a runtime created with a
+// wazero.CompilationCache, or no runtime and WithCompilationCache.
+type WASMPool struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	rt       wazero.Runtime
+	ownRT    bool // rt was created by NewWASMPool, and is closed by Close
+	cache    wazero.CompilationCache
+	compiled wazero.CompiledModule
+	opts     []DialOption
+	balancer Balancer
+
+	mu        sync.Mutex
+	instances []*poolInstance // nil while being replaced
+	next      int
+	changed   chan struct{} // closed when an instance is replaced
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type poolInstance struct {
+	*moduleInstance
+	busy int // guarded by WASMPool.mu
+}
+
+// NewWASMPool compiles wasm and starts size instances of it with rt. The
+// runtime must have WASI instantiated. If rt is nil, the pool creates a
+// runtime of its own with WASI, which uses the cache set by
+// WithCompilationCache, if any, and is closed by Close. The instances run
+// until the pool is closed or ctx is done.
+func NewWASMPool(ctx context.Context, rt wazero.Runtime, wasm []byte, size int, opts ...PoolOption) (*WASMPool, error) {
+	if size < 1 {
+		return nil, errors.New("pool size must be at least 1")
+	}
+	p := &WASMPool{
+		rt:        rt,
+		instances: make([]*poolInstance, size),
+		changed:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt.applyPool(p)
+	}
+	if rt == nil {
+		cfg := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+		if p.cache != nil {
+			cfg = cfg.WithCompilationCache(p.cache)
+		}
+		p.rt, p.ownRT = wazero.NewRuntimeWithConfig(ctx, cfg), true
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.rt); err != nil {
+			p.rt.Close(ctx)
+			return nil, err
+		}
+	} else if p.cache != nil {
+		return nil, errors.New("WithCompilationCache requires a nil runtime")
+	}
+	compiled, err := p.rt.CompileModule(ctx, wasm)
+	if err != nil {
+		if p.ownRT {
+			p.rt.Close(ctx)
+		}
+		return nil, err
+	}
+	p.compiled = compiled
+	p.ctx, p.cancel = context.WithCancel(ctx)
+
+	for i := range p.instances {
+		mi, err := startModule(p.ctx, p.rt, compiled, false, p.opts...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.instances[i] = &poolInstance{moduleInstance: mi}
+	}
+	for i, inst := range p.instances {
+		p.wg.Add(1)
+		go p.watch(i, inst)
+	}
+	go func() {
+		<-p.ctx.Done()
+		p.Close()
+	}()
+	return p, nil
+}
+
+// watch replaces the instance in slot i whenever it ends, until the pool is
+// closed.
+func (p *WASMPool) watch(i int, inst *poolInstance) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-inst.m.exited:
+		case <-p.ctx.Done():
+			return
+		}
+
+		p.mu.Lock()
+		p.instances[i] = nil
+		p.mu.Unlock()
+		logger := inst.errorLogger
+		if err := inst.m.err; err != nil {
+			logger.Error("WASM instance failed", "instance", i, "err", err)
+		} else {
+			logger.Warn("WASM instance exited", "instance", i)
+		}
+		inst.stop()
+
+		for {
+			mi, err := startModule(p.ctx, p.rt, p.compiled, false, p.opts...)
+			if err == nil {
+				inst = &poolInstance{moduleInstance: mi}
+				break
+			}
+			logger.Error("failed to replace WASM instance", "instance", i, "err", err)
+			select {
+			case <-time.After(restartDelay):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			inst.stop()
+			return
+		}
+		p.instances[i] = inst
+		close(p.changed)
+		p.changed = make(chan struct{})
+		p.mu.Unlock()
+	}
+}
+
+// pick returns the instance for the next conn, or nil if none is running.
+// p.mu must be held.
+func (p *WASMPool) pick() *poolInstance {
+	var best *poolInstance
+	for n := 0; n < len(p.instances); n++ {
+		i := (p.next + n) % len(p.instances)
+		inst := p.instances[i]
+		if inst == nil {
+			continue
+		}
+		if p.balancer == RoundRobin {
+			p.next = i + 1
+			return inst
+		}
+		if best == nil || inst.busy < best.busy {
+			best = inst
+		}
+	}
+	return best
+}
+
+// DialContext opens a conn to one of the instances. It has the signature
+// of net.Dialer.DialContext, so that it can be plugged into clients such as
+// http.Transport; network and address are ignored. If no instance is
+// running because all of them are being replaced, DialContext waits for
+// one.
+//
+// Unlike with Dial, ctx only bounds the dial itself. The conn stays open
+// until it is closed or the pool is closed.
+func (p *WASMPool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return p.open(ctx, p.ctx, nil)
+}
+
+// Open opens a conn to one of the instances like DialContext, which makes
+// the pool an endpoint for a Dialer. As with Dial, ctx bounds the whole
+// lifetime of the conn. The options are applied after the instance
+// options.
+func (p *WASMPool) Open(ctx context.Context, opts ...DialOption) (net.Conn, error) {
+	return p.open(ctx, ctx, opts)
+}
+
+func (p *WASMPool) open(ctx, connCtx context.Context, opts []DialOption) (net.Conn, error) {
+	var inst *poolInstance
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		inst = p.pick()
+		if inst != nil {
+			inst.busy++
+			p.mu.Unlock()
+			break
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ErrContextCanceled
+		}
+	}
+
+	var once sync.Once
+	release := func(context.Context) {
+		once.Do(func() {
+			p.mu.Lock()
+			inst.busy--
+			p.mu.Unlock()
+		})
+	}
+	opts = append(append([]DialOption(nil), p.opts...), opts...)
+	c, err := openConn(context.WithValue(connCtx, "disconnect", release), inst.s, opts...)
+	if err != nil {
+		release(ctx)
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops all instances, and closes the compiled module, or the
+// runtime if the pool created it. Conns dialed through the pool fail once their instance is gone.
+func (p *WASMPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	p.closed = true
+	instances := append([]*poolInstance(nil), p.instances...)
+	p.mu.Unlock()
+
+	p.cancel()
+	for _, inst := range instances {
+		if inst != nil {
+			inst.stop()
+		}
+	}
+	p.wg.Wait()
+	if p.ownRT {
+		p.rt.Close(context.Background())
+	} else {
+		p.compiled.Close(context.Background())
+	}
+	return nil
+}
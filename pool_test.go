@@ -0,0 +1,224 @@
+//go:build !wasip1
+
+package stdl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+func newPool(t *testing.T, ctx context.Context, size int, opts ...PoolOption) *WASMPool {
+	p, err := NewWASMPool(ctx, newWASIRuntime(t, ctx), echoModule.get(t), size, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// echoLine writes a line to c and checks that it comes back.
+func echoLine(t *testing.T, c net.Conn, line string) {
+	t.Helper()
+	if _, err := io.WriteString(c, line+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != line+"\n" {
+		t.Fatalf("expected %q, got %q", line+"\n", got)
+	}
+}
+
+// instanceOf returns the slot of the instance that c was dialed to.
+func instanceOf(p *WASMPool, c net.Conn) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, inst := range p.instances {
+		if inst != nil && inst.s == c.(*conn).s {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	ctx := testContext(t)
+	p := newPool(t, ctx, 3)
+
+	for i := 0; i < 6; i++ {
+		c, err := p.DialContext(ctx, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		echoLine(t, c, fmt.Sprintf("hello %d", i))
+		if got := instanceOf(p, c); got != i%3 {
+			t.Errorf("conn %d: expected instance %d, got %d", i, i%3, got)
+		}
+	}
+}
+
+func TestPoolIdle(t *testing.T) {
+	ctx := testContext(t)
+	p := newPool(t, ctx, 2)
+
+	// The instances only get the streams that are dialed to them.
+	for i, inst := range p.instances {
+		inst.s.mu.Lock()
+		n := len(inst.s.streams)
+		inst.s.mu.Unlock()
+		if n != 0 {
+			t.Errorf("instance %d: expected no streams, got %d", i, n)
+		}
+	}
+}
+
+func TestPoolLeastBusy(t *testing.T) {
+	ctx := testContext(t)
+	p := newPool(t, ctx, 3, WithBalancer(LeastBusy))
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := p.DialContext(ctx, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	// Free up the second instance. The busy count drops asynchronously.
+	conns[1].Close()
+	for {
+		p.mu.Lock()
+		busy := p.instances[1].busy
+		p.mu.Unlock()
+		if busy == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c, err := p.DialContext(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoLine(t, c, "hello")
+	if got := instanceOf(p, c); got != 1 {
+		t.Errorf("expected instance 1, got %d", got)
+	}
+}
+
+func TestPoolReplace(t *testing.T) {
+	ctx := testContext(t)
+	stderr := make(lineWriter, 16)
+	p := newPool(t, ctx, 2, WithInstanceOptions(WithErrorLogger(log.New(stderr, "", 0))))
+
+	c, err := p.DialContext(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "exit 5\n"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Read(make([]byte, 1))
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 5 {
+		t.Fatalf("expected exit code 5, got %v", err)
+	}
+	for line := range stderr {
+		if strings.HasPrefix(line, "WASM instance failed instance=0 ") {
+			break
+		}
+	}
+	go func() {
+		for range stderr {
+		}
+	}()
+
+	// Every conn works again once the instance has been replaced.
+	for i := 0; i < 4; i++ {
+		c, err := p.DialContext(ctx, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		echoLine(t, c, fmt.Sprintf("hello %d", i))
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	ctx := testContext(t)
+	p := newPool(t, ctx, 1)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.DialContext(ctx, "", ""); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+}
+
+func TestPoolEndpoint(t *testing.T) {
+	ctx := testContext(t)
+	p := newPool(t, ctx, 2)
+
+	var d Dialer
+	d.Register("echo", p)
+	for i := 0; i < 3; i++ {
+		c, err := d.DialContext(ctx, "io", "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		echoLine(t, c, fmt.Sprintf("hello %d", i))
+	}
+}
+
+func TestPoolCompilationCache(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close(ctx)
+
+	// Without a runtime, the pool creates one that compiles into the cache.
+	p, err := NewWASMPool(ctx, nil, echoModule.get(t), 1, WithCompilationCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	c, err := p.DialContext(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoLine(t, c, "hello")
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) == 0 {
+		t.Fatalf("expected the module in the cache, got %v, %v", entries, err)
+	}
+
+	// A runtime of the caller's does not use the cache.
+	_, err = NewWASMPool(ctx, newWASIRuntime(t, ctx), echoModule.get(t), 1, WithCompilationCache(cache))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
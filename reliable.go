@@ -0,0 +1,261 @@
+package stdl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetransmitTimeout is how long the writer waits for an ack in
+// reliable mode before it sends the records in flight again. The timeout
+// doubles with every retransmission without progress, up to
+// maxRetransmitBackoff times its initial value.
+const (
+	defaultRetransmitTimeout = 200 * time.Millisecond
+	maxRetransmitBackoff     = 32
+)
+
+// maxInFlight is how many records the writer sends in reliable mode before
+// it waits for an ack. The reader keeps as many records that arrived out of
+// order.
+const maxInFlight = 64
+
+// WithReliableDelivery makes the session that Dial or Listen starts over
+// their transport deliver every frame exactly once and in order, over
+// transports that drop, corrupt, duplicate or reorder chunks of bytes. The
+// frames are sent as records with checksums and sequence numbers, like with
+// WithChecksums, and the peer acknowledges the records it received. Records
+// that are not acknowledged within rto are sent again. An rto of 0 uses a
+// default of 200ms.
+//
+// Both ends must enable reliable delivery. With WithHandshake, they
+// announce FeatureReliable, and the handshake fails if only one of them
+// does. The hello itself is not sent again if it gets lost. The option has
+// no effect if a session already runs over the transport.
+func WithReliableDelivery(rto time.Duration) Option {
+	if rto <= 0 {
+		rto = defaultRetransmitTimeout
+	}
+	return optionReliableDelivery(rto)
+}
+
+type optionReliableDelivery time.Duration
+
+func (optionReliableDelivery) apply(*conn) error {
+	return nil
+}
+
+func (optionReliableDelivery) applyListener(*listener) {}
+
+func (opt optionReliableDelivery) applySession(cfg *sessionConfig) {
+	cfg.reliable = true
+	cfg.retransmitTimeout = time.Duration(opt)
+	cfg.checksums = true
+	cfg.checksumPolicy = ChecksumResync
+}
+
+// sentRecord is a record in flight.
+type sentRecord struct {
+	seq uint32
+	b   []byte
+}
+
+// receivedRecord is a record that arrived ahead of its turn.
+type receivedRecord struct {
+	h       header
+	payload []byte
+}
+
+// before tells whether the sequence number a comes before b, allowing for
+// wraparound.
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// advance raises a to seq, unless it is there already, and reports whether
+// it did.
+func advance(a *atomic.Uint32, seq uint32) bool {
+	for {
+		old := a.Load()
+		if !before(old, seq) {
+			return false
+		}
+		if a.CompareAndSwap(old, seq) {
+			return true
+		}
+	}
+}
+
+// sendReliable is the writer goroutine in reliable mode. It sends frames
+// as records over p, keeps them until the peer acknowledges them, and sends
+// them again when no ack arrives in time. Acks for the peer go out as soon
+// as the reader asks for them. Once p is lost, the writer keeps taking
+// frames, and waits for Resume to hand it the next transport.
+func (s *session) sendReliable(p io.ReadWriter, lost chan struct{}) {
+	var (
+		queue    = s.prelude
+		inFlight []sentRecord
+		timeout  = s.retransmitTimeout
+		timer    <-chan time.Time
+	)
+	write := func(b []byte) error {
+		_, err := p.Write(b)
+		if err != nil {
+			s.lose(lost, err)
+			p, timer = nil, nil
+		}
+		return err
+	}
+	// trim drops the records in flight that the peer acknowledged, and
+	// reports whether there were any.
+	trim := func(acked uint32) bool {
+		n := 0
+		for n < len(inFlight) && before(inFlight[n].seq, acked) {
+			n++
+		}
+		inFlight = inFlight[n:]
+		return n > 0
+	}
+	for {
+		queue = append(queue, s.ctrl.take()...)
+		// Frames keep being queued while the window is full or the
+		// transport is lost, as the reader must never block on the writer.
+		for p != nil && len(queue) > 0 && len(inFlight) < maxInFlight {
+			f := queue[0]
+			queue = queue[1:]
+			b := f.b
+			if !f.raw {
+				b = appendRecord(nil, s.sendSeq, f.b)
+				inFlight = append(inFlight, sentRecord{s.sendSeq, b})
+				s.sendSeq++
+				if timer == nil {
+					timer = time.After(timeout)
+				}
+			}
+			err := write(b)
+			if err != nil && s.resumable && !f.raw {
+				// The record goes out again after Resume.
+				err = nil
+			}
+			if f.done != nil {
+				f.done <- err
+			}
+		}
+
+		select {
+		case f := <-s.sendCh:
+			if f.claim() {
+				queue = append(queue, f)
+			}
+		case <-s.ctrl.ready:
+		case <-s.ackNeeded:
+			if p == nil {
+				continue
+			}
+			var seq [4]byte
+			binary.BigEndian.PutUint32(seq[:], s.ackSeq.Load())
+			// Acks have no sequence number of their own, so they take that
+			// of the next record.
+			write(appendRecord(nil, s.sendSeq, appendFrame(nil, header{typ: frameAck}, seq[:])))
+		case <-s.peerAcked:
+			if !trim(s.peerAck.Load()) || p == nil {
+				continue
+			}
+			timeout = s.retransmitTimeout
+			timer = nil
+			if len(inFlight) > 0 {
+				timer = time.After(timeout)
+			}
+		case <-timer:
+			s.eventLogger.Debug("retransmitting", "records", len(inFlight), "timeout", timeout)
+			for _, r := range inFlight {
+				if write(r.b) != nil {
+					break
+				}
+			}
+			if p == nil {
+				continue
+			}
+			if timeout < maxRetransmitBackoff*s.retransmitTimeout {
+				timeout *= 2
+			}
+			timer = time.After(timeout)
+		case <-lost:
+			p, lost, timer = nil, nil, nil
+		case t := <-s.resumed:
+			p, lost = t.p, t.lost
+			trim(t.peerSeq)
+			timeout = s.retransmitTimeout
+			for _, r := range inFlight {
+				if write(r.b) != nil {
+					break
+				}
+			}
+			if p != nil && len(inFlight) > 0 {
+				timer = time.After(timeout)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// recvReliable is the reader goroutine in reliable mode, for the transport
+// that r reads. It hands frames to handle in the order of their sequence
+// numbers, each of them once, and has the writer acknowledge what arrived.
+// Corrupted records count as lost, and the peer sends them again.
+func (s *session) recvReliable(r *bufio.Reader, lost chan struct{}) {
+	for {
+		h, payload, seq, err := s.readRecord(r)
+		var ce *ChecksumError
+		if errors.As(err, &ce) {
+			s.eventLogger.Debug("dropped corrupted frame", "err", ce)
+			continue
+		}
+		if err != nil {
+			s.fail(lost, err)
+			return
+		}
+		s.alive.Store(true)
+
+		if h.typ == frameAck {
+			if advance(&s.peerAck, binary.BigEndian.Uint32(payload)) {
+				signal(s.peerAcked)
+			}
+			continue
+		}
+		s.recvMu.Lock()
+		if isClosed(s.done) || isClosed(lost) {
+			// The session ended, or moved on to another transport.
+			s.recvMu.Unlock()
+			return
+		}
+		switch d := int32(seq - s.recvSeq); {
+		case d == 0:
+			s.handle(h, payload)
+			s.recvSeq++
+			for {
+				r, ok := s.pending[s.recvSeq]
+				if !ok {
+					break
+				}
+				delete(s.pending, s.recvSeq)
+				s.handle(r.h, r.payload)
+				s.recvSeq++
+			}
+		case d > 0 && d < maxInFlight:
+			if s.pending == nil {
+				s.pending = make(map[uint32]receivedRecord)
+			}
+			s.pending[seq] = receivedRecord{h, payload}
+		}
+		// Duplicates are acknowledged as well, as the earlier ack may have
+		// been lost.
+		s.ackSeq.Store(s.recvSeq)
+		s.recvMu.Unlock()
+		signal(s.ackNeeded)
+	}
+}
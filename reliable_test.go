@@ -0,0 +1,198 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPipe is a transport that drops, truncates, corrupts, duplicates and
+// reorders the chunks written to it, each with probability p.
+type lossyPipe struct {
+	io.ReadWriter
+	p float64
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	held   []byte
+	faults int
+}
+
+func newLossyPipe(rw io.ReadWriter, p float64, seed int64) *lossyPipe {
+	return &lossyPipe{ReadWriter: rw, p: p, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (lp *lossyPipe) Write(b []byte) (int, error) {
+	chunk := append([]byte(nil), b...)
+	var out [][]byte
+	lp.mu.Lock()
+	lp.faults++
+	switch r := lp.rand.Float64(); {
+	case r < lp.p:
+		// Dropped.
+	case r < 2*lp.p:
+		out = append(out, chunk[:lp.rand.Intn(len(chunk))])
+	case r < 3*lp.p:
+		chunk[lp.rand.Intn(len(chunk))] ^= 0x20
+		out = append(out, chunk)
+	case r < 4*lp.p:
+		out = append(out, chunk, chunk)
+	case r < 5*lp.p && lp.held == nil:
+		// Sent after the next chunk.
+		lp.held = chunk
+	default:
+		lp.faults--
+		out = append(out, chunk)
+	}
+	if lp.held != nil && len(out) > 0 {
+		out = append(out, lp.held)
+		lp.held = nil
+	}
+	lp.mu.Unlock()
+
+	for _, c := range out {
+		if _, err := lp.ReadWriter.Write(c); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (lp *lossyPipe) Faults() int {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.faults
+}
+
+func TestReliableDelivery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	p, q := PipePair()
+	lp, lq := newLossyPipe(p, 0.04, 1), newLossyPipe(q, 0.04, 2)
+	l := Listen(ctx, lp, WithReliableDelivery(5*time.Millisecond))
+	defer l.Close()
+	go echo(l)
+
+	// Several streams echo data concurrently, and each gets its own data
+	// back, complete and in order.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		c, err := Dial(ctx, lq, WithReliableDelivery(5*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		data := make([]byte, 100<<10)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go c.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(c, got); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- io.ErrUnexpectedEOF
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if lp.Faults() == 0 || lq.Faults() == 0 {
+		t.Fatalf("expected faults, got %d and %d", lp.Faults(), lq.Faults())
+	}
+}
+
+// readTestRecord reads a record from r.
+func readTestRecord(t *testing.T, r io.Reader) (seq uint32, h header, payload []byte) {
+	t.Helper()
+	b := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	h.decode(b[6:])
+	if h.length > 0 {
+		payload = make([]byte, h.length+4)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatal(err)
+		}
+		payload = payload[:h.length]
+	}
+	return binary.BigEndian.Uint32(b[2:]), h, payload
+}
+
+// writeRecord writes a record as the peer in reliable mode would.
+func writeRecord(t *testing.T, w io.Writer, seq uint32, h header, payload []byte) {
+	t.Helper()
+	if _, err := w.Write(appendRecord(nil, seq, appendFrame(nil, h, payload))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReliableOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := BufferedPipePair(1 << 16)
+	l := Listen(ctx, p, WithReliableDelivery(time.Second))
+	defer l.Close()
+
+	// Records that arrive out of order or twice are handed on in order,
+	// once.
+	writeRecord(t, q, 2, header{typ: frameData, stream: 1}, []byte("c"))
+	writeRecord(t, q, 0, header{typ: frameOpen, stream: 1}, nil)
+	writeRecord(t, q, 0, header{typ: frameOpen, stream: 1}, nil)
+	writeRecord(t, q, 1, header{typ: frameData, stream: 1}, []byte("ab"))
+	writeRecord(t, q, 2, header{typ: frameData, stream: 1}, []byte("c"))
+	writeRecord(t, q, 3, header{typ: frameClose, stream: 1}, nil)
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abc" {
+		t.Fatalf("expected %q, got %q", "abc", got)
+	}
+
+	// The listener acknowledges all four records.
+	for {
+		_, h, payload := readTestRecord(t, q)
+		if h.typ == frameAck && binary.BigEndian.Uint32(payload) == 4 {
+			break
+		}
+	}
+}
+
+func TestReliableRetransmit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// Nothing is acknowledged, so the open record is sent again.
+	p, q := PipePair()
+	go Dial(ctx, q, WithReliableDelivery(5*time.Millisecond))
+	for opens := 0; opens < 3; {
+		seq, h, _ := readTestRecord(t, p)
+		if h.typ == frameOpen {
+			if seq != 0 {
+				t.Fatalf("expected the open record to have seq 0, got %d", seq)
+			}
+			opens++
+		}
+	}
+}
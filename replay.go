@@ -0,0 +1,449 @@
+package stdl
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcriptHeader is the first line of a transcript file.
+const transcriptHeader = "stdl transcript v1"
+
+// maxTranscriptLine limits the lines of a transcript, which hold a chunk of
+// data in hex each.
+const maxTranscriptLine = 16 << 20
+
+// Event is a chunk of data in a Transcript.
+type Event struct {
+	// Offset is the time since the recording started.
+	Offset time.Duration
+	// Write is true for data written to the transport, false for data read
+	// from it.
+	Write bool
+	// EOF marks the end of the data read from the transport. It has no
+	// Data.
+	EOF  bool
+	Data []byte
+}
+
+// Transcript is the data that went both ways over a transport, in order.
+//
+// Its text form, as written by WriteTo, has a header line followed by one
+// line per event with the offset, "w" or "r" for the direction, and the
+// data in hex or EOF:
+//
+//	stdl transcript v1
+//	+1.2ms w 0100000000010000000000
+//	+1.5ms r EOF
+//
+// Empty lines and lines starting with # are ignored.
+type Transcript struct {
+	Events []Event
+}
+
+// ReadTranscript parses a transcript in the format written by WriteTo.
+func ReadTranscript(r io.Reader) (*Transcript, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxTranscriptLine)
+	t := new(Transcript)
+	line := 0
+	header := false
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if !header {
+			if text != transcriptHeader {
+				return nil, fmt.Errorf("transcript line %d: expected %q", line, transcriptHeader)
+			}
+			header = true
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("transcript line %d: expected 3 fields, got %d", line, len(fields))
+		}
+		var e Event
+		var err error
+		if e.Offset, err = time.ParseDuration(strings.TrimPrefix(fields[0], "+")); err != nil {
+			return nil, fmt.Errorf("transcript line %d: %w", line, err)
+		}
+		switch fields[1] {
+		case "w":
+			e.Write = true
+		case "r":
+		default:
+			return nil, fmt.Errorf("transcript line %d: unknown direction %q", line, fields[1])
+		}
+		if fields[2] == "EOF" && !e.Write {
+			e.EOF = true
+		} else if e.Data, err = hex.DecodeString(fields[2]); err != nil {
+			return nil, fmt.Errorf("transcript line %d: %w", line, err)
+		}
+		t.Events = append(t.Events, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, errors.New("transcript is empty")
+	}
+	return t, nil
+}
+
+// ReadTranscriptFile reads a transcript from the named file, typically a
+// golden file under testdata.
+func ReadTranscriptFile(name string) (*Transcript, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTranscript(f)
+}
+
+// WriteTo writes t in its text form.
+func (t *Transcript) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	fmt.Fprintln(cw, transcriptHeader)
+	for _, e := range t.Events {
+		dir := "r"
+		if e.Write {
+			dir = "w"
+		}
+		data := hex.EncodeToString(e.Data)
+		if e.EOF {
+			data = "EOF"
+		}
+		fmt.Fprintf(cw, "+%s %s %s\n", e.Offset, dir, data)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// WriteFile writes t to the named file.
+func (t *Transcript) WriteFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := t.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+// Recorder is an io.ReadWriter that records everything read from and
+// written to another io.ReadWriter. Pass it to Dial or Listen in place of
+// the transport, and save its Transcript once done.
+type Recorder struct {
+	rw    io.ReadWriter
+	start time.Time
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewRecorder returns a Recorder for rw.
+func NewRecorder(rw io.ReadWriter) *Recorder {
+	return &Recorder{rw: rw, start: time.Now()}
+}
+
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.rw.Read(b)
+	if n > 0 {
+		r.record(Event{Data: append([]byte(nil), b[:n]...)})
+	}
+	if err == io.EOF {
+		r.record(Event{EOF: true})
+	}
+	return n, err
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	n, err := r.rw.Write(b)
+	if n > 0 {
+		r.record(Event{Write: true, Data: append([]byte(nil), b[:n]...)})
+	}
+	return n, err
+}
+
+func (r *Recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Offset = time.Since(r.start)
+	r.events = append(r.events, e)
+}
+
+// SetReadDeadline sets the read deadline of the recorded io.ReadWriter,
+// if it has one.
+func (r *Recorder) SetReadDeadline(t time.Time) error {
+	if d, ok := r.rw.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// Close closes the recorded io.ReadWriter, if it is an io.Closer.
+func (r *Recorder) Close() error {
+	if c, ok := r.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Transcript returns what has been recorded so far.
+func (r *Recorder) Transcript() *Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Transcript{Events: append([]Event(nil), r.events...)}
+}
+
+// ErrReplayMismatch is wrapped by the errors of a Replayer whose writes do
+// not match its transcript.
+var ErrReplayMismatch error = errors.New("replay mismatch")
+
+// ReplayError tells where the writes to a Replayer first differed from its
+// transcript.
+type ReplayError struct {
+	// Event is the index in the transcript of the write event that
+	// differs, or the number of events if there are more writes than
+	// recorded.
+	Event int
+	// Offset is the position of the first differing byte in the stream of
+	// written data.
+	Offset int64
+	// Want and Got are the bytes around the difference.
+	Want, Got []byte
+}
+
+func (e *ReplayError) Error() string {
+	if e.Want == nil {
+		return fmt.Sprintf("%s: unexpected write at byte %d after the end of the transcript:\n  got:  % x", ErrReplayMismatch, e.Offset, e.Got)
+	}
+	if e.Got == nil {
+		return fmt.Sprintf("%s: missing write at byte %d (event %d):\n  want: % x", ErrReplayMismatch, e.Offset, e.Event, e.Want)
+	}
+	return fmt.Sprintf("%s: write differs at byte %d (event %d):\n  want: % x\n  got:  % x", ErrReplayMismatch, e.Offset, e.Event, e.Want, e.Got)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return ErrReplayMismatch
+}
+
+// replayContext is the number of bytes a ReplayError shows around a
+// difference.
+const replayContext = 16
+
+// Replayer is an io.ReadWriter that plays the peer of a recorded
+// transport. Reads return the data that was read in the transcript, each
+// chunk once everything written before it in the transcript has been
+// written to the Replayer. Writes are checked against the data written in
+// the transcript, as a golden file. Timing is not replayed.
+//
+// The first difference fails that Write, and every later Read and Write,
+// with a *ReplayError. Once the transcript is exhausted, Read blocks until
+// the Replayer is closed, unless the transcript ends with EOF.
+//
+// Replaying only works as long as the frames are written in the same order
+// as when recording, which is the case for a single stream, or streams
+// taking turns.
+type Replayer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// want is all data written in the transcript and written how much of
+	// it has been matched.
+	want    []byte
+	written int
+	// writeEnds has the offset in want after every write event, to map
+	// offsets back to events.
+	writeEnds []int
+	writeIdx  []int
+
+	reads  []replayRead
+	next   int // next read
+	offset int // into the data of the next read
+
+	err      error
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// replayRead is a read event with the amount of data that must have been
+// written before it.
+type replayRead struct {
+	after int
+	e     Event
+}
+
+// NewReplayer returns a Replayer for t.
+func NewReplayer(t *Transcript) *Replayer {
+	r := new(Replayer)
+	r.cond = sync.NewCond(&r.mu)
+	for i, e := range t.Events {
+		if e.Write {
+			r.want = append(r.want, e.Data...)
+			r.writeEnds = append(r.writeEnds, len(r.want))
+			r.writeIdx = append(r.writeIdx, i)
+			continue
+		}
+		r.reads = append(r.reads, replayRead{after: len(r.want), e: e})
+	}
+	return r
+}
+
+// eventAt returns the index of the write event holding byte off of want.
+func (r *Replayer) eventAt(off int) int {
+	for i, end := range r.writeEnds {
+		if off < end {
+			return r.writeIdx[i]
+		}
+	}
+	return len(r.writeIdx) + len(r.reads)
+}
+
+func (r *Replayer) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		switch {
+		case r.err != nil:
+			return 0, r.err
+		case r.closed:
+			return 0, io.EOF
+		case !r.deadline.IsZero() && !time.Now().Before(r.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		if r.next < len(r.reads) && r.written >= r.reads[r.next].after {
+			read := r.reads[r.next]
+			if read.e.EOF {
+				return 0, io.EOF
+			}
+			n := copy(b, read.e.Data[r.offset:])
+			r.offset += n
+			if r.offset == len(read.e.Data) {
+				r.next++
+				r.offset = 0
+			}
+			return n, nil
+		}
+		r.cond.Wait()
+	}
+}
+
+func (r *Replayer) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	rest := r.want[r.written:]
+	n := 0
+	for n < len(b) && n < len(rest) && b[n] == rest[n] {
+		n++
+	}
+	r.written += n
+	defer r.cond.Broadcast()
+	if n == len(b) {
+		return n, nil
+	}
+
+	off := r.written
+	from := off - replayContext/2
+	if from < 0 {
+		from = 0
+	}
+	e := &ReplayError{Event: r.eventAt(off), Offset: int64(off)}
+	got := append(r.want[from:off:off], b[n:]...)
+	if len(got) > replayContext {
+		got = got[:replayContext]
+	}
+	e.Got = got
+	if off < len(r.want) {
+		want := r.want[from:]
+		if len(want) > replayContext {
+			want = want[:replayContext]
+		}
+		e.Want = want
+	}
+	r.err = e
+	return n, e
+}
+
+// SetReadDeadline makes pending and future Reads fail with
+// os.ErrDeadlineExceeded once t has passed.
+func (r *Replayer) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = t
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if !t.IsZero() {
+		r.timer = time.AfterFunc(time.Until(t), func() {
+			r.mu.Lock()
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		})
+	}
+	r.cond.Broadcast()
+	return nil
+}
+
+// Close makes pending and future Reads return io.EOF.
+func (r *Replayer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
+
+// Check returns the *ReplayError of the first difference, or one for the
+// data of the transcript that has not been written yet, if any.
+func (r *Replayer) Check() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.written == len(r.want) {
+		return r.err
+	}
+	want := r.want[r.written:]
+	if len(want) > replayContext {
+		want = want[:replayContext]
+	}
+	return &ReplayError{Event: r.eventAt(r.written), Offset: int64(r.written), Want: want}
+}
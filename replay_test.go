@@ -0,0 +1,229 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden transcripts")
+
+const echoTranscript = "testdata/replay/echo.transcript"
+
+// stream returns the data written or read in t, concatenated.
+func stream(t *Transcript, write bool) []byte {
+	var b []byte
+	for _, e := range t.Events {
+		if e.Write == write {
+			b = append(b, e.Data...)
+		}
+	}
+	return b
+}
+
+// echoHello opens a conn over p, has "hello" echoed and closes the conn.
+func echoHello(t *testing.T, ctx context.Context, p io.ReadWriter) {
+	t.Helper()
+	c, err := Dial(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+	c.Close()
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	rec := NewRecorder(q)
+	echoHello(t, ctx, rec)
+	<-done
+	// Wait for the close of the peer to be read.
+	peerClose := appendFrame(nil, header{typ: frameClose, stream: 1}, nil)
+	for !bytes.HasSuffix(stream(rec.Transcript(), false), peerClose) {
+		time.Sleep(time.Millisecond)
+	}
+
+	got := rec.Transcript()
+	if *update {
+		if err := got.WriteFile(echoTranscript); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ReadTranscriptFile(echoTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, write := range []bool{true, false} {
+		if g, w := stream(got, write), stream(want, write); !bytes.Equal(g, w) {
+			t.Errorf("write=%t: expected\n% x\ngot\n% x", write, w, g)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tr, err := ReadTranscriptFile(echoTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReplayer(tr)
+	echoHello(t, ctx, r)
+	for r.Check() != nil {
+		// The close frame is written asynchronously.
+		time.Sleep(time.Millisecond)
+		if ctx.Err() != nil {
+			t.Fatal(r.Check())
+		}
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tr, err := ReadTranscriptFile(echoTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReplayer(tr)
+	c, err := Dial(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "jello")
+
+	// The conn fails, and the Replayer tells why.
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("expected ErrReplayMismatch, got %v", err)
+	}
+	var re *ReplayError
+	if !errors.As(r.Check(), &re) {
+		t.Fatalf("expected a *ReplayError, got %v", r.Check())
+	}
+	if re.Event != 2 || !strings.Contains(re.Error(), "write differs at byte 34 (event 2)") {
+		t.Fatalf("unexpected error %v", re)
+	}
+}
+
+func TestReplayError(t *testing.T) {
+	tr := &Transcript{Events: []Event{
+		{Write: true, Data: []byte("abc")},
+		{Data: []byte("xyz")},
+		{Write: true, Data: []byte("def")},
+	}}
+
+	r := NewReplayer(tr)
+	if _, err := r.Write([]byte("abcdeX")); err == nil {
+		t.Fatal("expected an error")
+	}
+	want := "replay mismatch: write differs at byte 5 (event 2):\n  want: 61 62 63 64 65 66\n  got:  61 62 63 64 65 58"
+	if got := r.Check().Error(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	r = NewReplayer(tr)
+	r.Write([]byte("ab"))
+	if err := r.Check(); err == nil || !strings.Contains(err.Error(), "missing write at byte 2 (event 0)") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	r.Write([]byte("cdef"))
+	if err := r.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("!")); err == nil || !strings.Contains(err.Error(), "unexpected write at byte 6") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestReplayReadOrder(t *testing.T) {
+	r := NewReplayer(&Transcript{Events: []Event{
+		{Data: []byte("hi")},
+		{Write: true, Data: []byte("ok")},
+		{Data: []byte("bye")},
+		{EOF: true},
+	}})
+	buf := make([]byte, 8)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("expected hi, got %q, %v", buf[:n], err)
+	}
+
+	// The next chunk waits for the write before it.
+	r.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := r.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	r.SetReadDeadline(time.Time{})
+	r.Write([]byte("ok"))
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("expected bye, got %q, %v", buf[:n], err)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestTranscriptFormat(t *testing.T) {
+	tr := &Transcript{Events: []Event{
+		{Offset: time.Millisecond, Write: true, Data: []byte{0, 1}},
+		{Offset: 2 * time.Millisecond, Data: []byte("x")},
+		{Offset: 3 * time.Millisecond, EOF: true},
+	}}
+	var buf bytes.Buffer
+	if _, err := tr.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "stdl transcript v1\n+1ms w 0001\n+2ms r 78\n+3ms r EOF\n"
+	if buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+	got, err := ReadTranscript(strings.NewReader("# comment\n\n" + buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Events) != 3 || got.Events[1].Offset != 2*time.Millisecond || string(got.Events[1].Data) != "x" || !got.Events[2].EOF {
+		t.Fatalf("unexpected events %+v", got.Events)
+	}
+
+	for _, bad := range []string{"", "nope\n", transcriptHeader + "\n+1ms x 00\n", transcriptHeader + "\n+1ms w zz\n", transcriptHeader + "\nsoon w 00\n"} {
+		if _, err := ReadTranscript(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package stdl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"time"
+)
+
+// ErrNotResumable is returned by Resume for a session without
+// WithResumption.
+var ErrNotResumable error = errors.New("session is not resumable")
+
+// Resumer is implemented by the net.Conns and net.Listeners of this
+// package. Resume moves the session that they belong to over to rw, as
+// described in WithResumption.
+type Resumer interface {
+	Resume(ctx context.Context, rw io.ReadWriter) error
+}
+
+// tokenSize is the size of the token that authenticates Resume, and
+// nonceSize that of the nonces sent along with it.
+const (
+	tokenSize = 16
+	nonceSize = 16
+)
+
+// resumeMagic starts the messages that the ends exchange over the new
+// transport in Resume. The token never crosses the transport. Each end
+// sends
+//
+//	magic(4) nonce(16)
+//	HMAC(token, nonce ‖ peer nonce)
+//	seq(4) HMAC(token, nonce ‖ peer nonce ‖ seq)
+//
+// each message once it has received the previous one of the peer, where
+// seq is the sequence number of the next record that the end expects, and
+// HMAC is HMAC-SHA256. The first two messages prove that the peer knows
+// the token, before Resume gives up the old transport.
+var resumeMagic = [4]byte{'S', 'T', 'D', 'R'}
+
+const (
+	resumeHelloSize = 4 + nonceSize
+	resumeProofSize = sha256.Size
+	resumeSeqSize   = 4 + sha256.Size
+)
+
+// WithResumption makes the session that Dial or Listen starts over their
+// transport survive the loss of the transport. It implies
+// WithReliableDelivery, with the default retransmit timeout unless that
+// option sets another one. The dialer sends the listener a random token
+// when the session starts.
+//
+// When the transport fails, the session is suspended instead of ended, and
+// the function given to WithDisconnectFunc is called. Pending and future
+// calls on its conns wait, unless their ctx or deadline ends them. Resume
+// on any conn or the listener of the session moves it over to a new
+// transport, once the peer calls Resume with its end of it and proves that
+// it has the same token, which itself never crosses the new transport. A
+// Resume that fails that check leaves the session on its old transport.
+// Both ends then send the records that the other did not receive,
+// so no data is lost or duplicated. Resume may also replace a transport
+// that did not fail yet, and closes the old transport if it is an
+// io.Closer. With WithKeepalive, a session that is not resumed in time
+// still ends.
+//
+// Both ends must enable resumption, and keep running: a session cannot be
+// resumed by a process that lost its state. A write that hangs on an old
+// transport that cannot be closed is not interrupted. The option has no
+// effect if a session already runs over the transport.
+func WithResumption() Option {
+	return optionResumption{}
+}
+
+type optionResumption struct{}
+
+func (optionResumption) apply(*conn) error {
+	return nil
+}
+
+func (optionResumption) applyListener(*listener) {}
+
+func (optionResumption) applySession(cfg *sessionConfig) {
+	cfg.resumable = true
+	cfg.reliable = true
+	if cfg.retransmitTimeout == 0 {
+		cfg.retransmitTimeout = defaultRetransmitTimeout
+	}
+	cfg.checksums = true
+	cfg.checksumPolicy = ChecksumResync
+}
+
+// resumedTransport is what Resume hands to the writer goroutine: the new
+// transport, the channel closed once it is lost, and the sequence number
+// of the next record that the peer expects.
+type resumedTransport struct {
+	p       io.ReadWriter
+	lost    chan struct{}
+	peerSeq uint32
+}
+
+// newResumeToken returns a random token for Resume.
+func newResumeToken() []byte {
+	token := make([]byte, tokenSize)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// Resume moves the session of c over to rw.
+func (c *conn) Resume(ctx context.Context, rw io.ReadWriter) error {
+	return c.s.resume(ctx, rw)
+}
+
+// Resume moves the session of l over to rw.
+func (l *listener) Resume(ctx context.Context, rw io.ReadWriter) error {
+	return l.s.resume(ctx, rw)
+}
+
+// suspend marks the transport of lost as lost, and reports whether it was
+// not already.
+func (s *session) suspend(lost chan struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if isClosed(lost) {
+		return false
+	}
+	close(lost)
+	return true
+}
+
+// resume stops using the current transport, and goes on over rw after
+// exchanging resume messages with the peer. If the peer cannot prove that
+// it knows the token, the session goes on as before. If the exchange fails
+// later, the session stays suspended. Either way, rw should not be used
+// again.
+func (s *session) resume(ctx context.Context, rw io.ReadWriter) error {
+	if !s.resumable {
+		return ErrNotResumable
+	}
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	if isClosed(s.done) {
+		return s.err
+	}
+	s.mu.Lock()
+	token, old, lost := s.token, s.p, s.lost
+	s.mu.Unlock()
+	if token == nil {
+		return &HandshakeError{Reason: "no resume token received from the dialer"}
+	}
+	nonce, peerNonce, err := authenticate(ctx, rw, token)
+	if err != nil {
+		return err
+	}
+
+	// The old reader stops before it hands on another record, so recvSeq
+	// no longer changes. The writer keeps the records in flight. Closing
+	// the old transport frees a writer blocked on it, here and at the peer.
+	s.suspend(lost)
+	if old != rw {
+		if c, ok := old.(io.Closer); ok {
+			c.Close()
+		} else if d, ok := old.(readDeadliner); ok {
+			d.SetReadDeadline(time.Now())
+		}
+	}
+	s.recvMu.Lock()
+	seq := s.recvSeq
+	s.recvMu.Unlock()
+
+	peerSeq, err := exchangeSeq(ctx, rw, token, nonce, peerNonce, seq)
+	if err != nil {
+		return err
+	}
+	s.eventLogger.Info("resuming session", "recvSeq", seq, "peerSeq", peerSeq)
+
+	r := bufio.NewReaderSize(rw, s.bufferSize)
+	next := make(chan struct{})
+	s.mu.Lock()
+	s.p, s.r, s.lost = rw, r, next
+	s.mu.Unlock()
+	if s.shared {
+		sessions.Lock()
+		if sessions.m[old] == s {
+			delete(sessions.m, old)
+		}
+		if _, ok := sessions.m[rw]; !ok && reflect.TypeOf(rw).Comparable() {
+			sessions.m[rw] = s
+		}
+		sessions.Unlock()
+	}
+	if advance(&s.peerAck, peerSeq) {
+		signal(s.peerAcked)
+	}
+
+	select {
+	case s.resumed <- resumedTransport{rw, next, peerSeq}:
+	case <-s.done:
+		return s.err
+	}
+	go s.recv(r, next)
+	return nil
+}
+
+// authenticate exchanges nonces with the peer over rw, and checks that the
+// peer knows token. It returns the nonces of this end and of the peer.
+func authenticate(ctx context.Context, rw io.ReadWriter, token []byte) ([]byte, []byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	hello, err := exchangeMsg(ctx, rw, append(resumeMagic[:], nonce...), resumeHelloSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hello[:4], resumeMagic[:]) {
+		return nil, nil, &HandshakeError{Reason: "peer did not send a resume message"}
+	}
+	peerNonce := hello[4:]
+	if bytes.Equal(peerNonce, nonce) {
+		// The peer could pass the check by sending back the proof of
+		// this end.
+		return nil, nil, &HandshakeError{Reason: "peer sent back the resume nonce"}
+	}
+
+	proof, err := exchangeMsg(ctx, rw, resumeMAC(token, nonce, peerNonce), resumeProofSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(proof, resumeMAC(token, peerNonce, nonce)) != 1 {
+		return nil, nil, &HandshakeError{Reason: "resume token mismatch"}
+	}
+	return nonce, peerNonce, nil
+}
+
+// exchangeSeq sends seq over rw, and returns the seq that the peer sent.
+// Both are authenticated with token and the nonces.
+func exchangeSeq(ctx context.Context, rw io.ReadWriter, token, nonce, peerNonce []byte, seq uint32) (uint32, error) {
+	b := binary.BigEndian.AppendUint32(nil, seq)
+	msg, err := exchangeMsg(ctx, rw, append(b, resumeMAC(token, nonce, peerNonce, b)...), resumeSeqSize)
+	if err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare(msg[4:], resumeMAC(token, peerNonce, nonce, msg[:4])) != 1 {
+		return 0, &HandshakeError{Reason: "resume token mismatch"}
+	}
+	return binary.BigEndian.Uint32(msg), nil
+}
+
+// resumeMAC returns the HMAC-SHA256 of parts with token as the key.
+func resumeMAC(token []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, token)
+	for _, b := range parts {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// exchangeMsg writes msg to rw while it reads n bytes from rw, and returns
+// those.
+func exchangeMsg(ctx context.Context, rw io.ReadWriter, msg []byte, n int) ([]byte, error) {
+	written := make(chan error, 1)
+	go func() {
+		_, err := rw.Write(msg)
+		written <- err
+	}()
+	read := make(chan error, 1)
+	peer := make([]byte, n)
+	go func() {
+		_, err := io.ReadFull(rw, peer)
+		read <- err
+	}()
+
+	for written != nil || read != nil {
+		select {
+		case err := <-written:
+			if err != nil {
+				return nil, err
+			}
+			written = nil
+		case err := <-read:
+			if err != nil {
+				return nil, err
+			}
+			read = nil
+		case <-ctx.Done():
+			return nil, ErrContextCanceled
+		}
+	}
+	return peer, nil
+}
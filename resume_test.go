@@ -0,0 +1,164 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// resume resumes the sessions of c and l over a new pipe.
+func resume(t *testing.T, ctx context.Context, c net.Conn, l net.Listener) {
+	t.Helper()
+	p, q := PipePair()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- l.(Resumer).Resume(ctx, p)
+	}()
+	if err := c.(Resumer).Resume(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	p, q := PipePair()
+	disconnects := make(chan error, 2)
+	onDisconnect := WithDisconnectFunc(func(err error) {
+		disconnects <- err
+	})
+	l := Listen(ctx, p, WithResumption(), onDisconnect)
+	defer l.Close()
+	go echo(l)
+	c, err := Dial(ctx, q, WithResumption(), onDisconnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got[:64<<10]); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c, got[64<<10:])
+		read <- err
+	}()
+
+	// The transport breaks while the data is on its way. Both ends are
+	// suspended, and the rest of the data arrives once they are resumed.
+	p.Close()
+	q.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-disconnects:
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		case <-ctx.Done():
+			t.Fatal("disconnect func not called")
+		}
+	}
+	select {
+	case err := <-read:
+		t.Fatalf("expected the read to wait for Resume, got %v", err)
+	default:
+	}
+	resume(t, ctx, c, l)
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data lost or duplicated")
+	}
+	testEcho(t, c)
+}
+
+func TestResumeTokenMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p, WithResumption())
+	defer l.Close()
+	go echo(l)
+	c, err := Dial(ctx, q, WithResumption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+
+	// A Resume without a peer does not disturb the session.
+	shortCtx, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	p3, _ := PipePair()
+	if err := l.(Resumer).Resume(shortCtx, p3); err != ErrContextCanceled {
+		t.Fatalf("expected %v, got %v", ErrContextCanceled, err)
+	}
+	testEcho(t, c)
+
+	// A peer without the token cannot take over the session, and does not
+	// learn the token either.
+	p2, q2 := PipePair()
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(q2)
+		received <- b
+	}()
+	go func() {
+		q2.Write(append(resumeMagic[:], make([]byte, nonceSize)...))
+		q2.Write(make([]byte, resumeProofSize))
+	}()
+	err = l.(Resumer).Resume(ctx, p2)
+	var he *HandshakeError
+	if !errors.As(err, &he) || he.Reason != "resume token mismatch" {
+		t.Fatalf("expected a token mismatch, got %v", err)
+	}
+	p2.Close()
+	s := l.(*listener).s
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	if b := <-received; len(b) == 0 || bytes.Contains(b, token) {
+		t.Fatalf("expected resume messages without the token, got %x", b)
+	}
+
+	// The session goes on over the original transport, and the dialer can
+	// still resume it.
+	testEcho(t, c)
+	resume(t, ctx, c, l)
+	testEcho(t, c)
+}
+
+func TestResumeNotResumable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, q := PipePair()
+	l := Listen(ctx, p)
+	defer l.Close()
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r, _ := PipePair()
+	if err := c.(Resumer).Resume(ctx, r); err != ErrNotResumable {
+		t.Fatalf("expected %v, got %v", ErrNotResumable, err)
+	}
+}
@@ -0,0 +1,237 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownScheme is returned by Open and OpenListener for a URL whose
+// scheme is not registered.
+var ErrUnknownScheme error = errors.New("unknown URL scheme")
+
+// Scheme opens the transports of a URL scheme for Open and OpenListener.
+type Scheme interface {
+	Dial(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error)
+	Listen(ctx context.Context, u *url.URL, opts ...ListenOption) (net.Listener, error)
+}
+
+// SchemeFuncs implements Scheme with a function per method. A nil function
+// means that the scheme cannot be used that way.
+type SchemeFuncs struct {
+	DialFunc   func(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error)
+	ListenFunc func(ctx context.Context, u *url.URL, opts ...ListenOption) (net.Listener, error)
+}
+
+func (s SchemeFuncs) Dial(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error) {
+	if s.DialFunc == nil {
+		return nil, fmt.Errorf("cannot dial %s URLs", u.Scheme)
+	}
+	return s.DialFunc(ctx, u, opts...)
+}
+
+func (s SchemeFuncs) Listen(ctx context.Context, u *url.URL, opts ...ListenOption) (net.Listener, error) {
+	if s.ListenFunc == nil {
+		return nil, fmt.Errorf("cannot listen on %s URLs", u.Scheme)
+	}
+	return s.ListenFunc(ctx, u, opts...)
+}
+
+var schemes = struct {
+	sync.RWMutex
+	m map[string]Scheme
+}{m: map[string]Scheme{
+	"exec": SchemeFuncs{DialFunc: dialExecURL},
+	"fifo": SchemeFuncs{DialFunc: dialFIFOURL, ListenFunc: listenFIFOURL},
+	"pipe": SchemeFuncs{DialFunc: dialPipeURL, ListenFunc: listenPipeURL},
+}}
+
+// RegisterScheme makes s available to Open and OpenListener for URLs with
+// the given scheme, replacing any scheme registered under that name.
+func RegisterScheme(name string, s Scheme) {
+	schemes.Lock()
+	defer schemes.Unlock()
+	schemes.m[strings.ToLower(name)] = s
+}
+
+func lookupScheme(rawURL string) (*url.URL, Scheme, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	schemes.RLock()
+	s, ok := schemes.m[u.Scheme]
+	schemes.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %q", ErrUnknownScheme, u.Scheme)
+	}
+	return u, s, nil
+}
+
+// Open dials the transport described by rawURL. These schemes are built in:
+//
+//	exec:///usr/bin/plugin?arg=-v   runs a command, as DialCommand does
+//	wasm:///path/mod.wasm?arg=-v    runs a WASM module, as DialWASM does
+//	fifo:///tmp/in,/tmp/out         reads from one FIFO and writes to another
+//	pipe://name                     connects to a name published with ListenName
+//
+// Commands and WASM modules also take env=KEY=VALUE parameters, and
+// commands a dir parameter. A command without a leading slash, such as
+// exec://plugin, is looked up in PATH. FIFOs must exist already. Both
+// sides name the one they read from first. The wasm scheme is missing when
+// stdl itself is built for wasip1.
+//
+// Further schemes can be added with RegisterScheme.
+func Open(ctx context.Context, rawURL string, opts ...DialOption) (net.Conn, error) {
+	u, s, err := lookupScheme(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dial(ctx, u, opts...)
+}
+
+// OpenListener serves a Listener on the transport described by rawURL. Of
+// the built-in schemes, fifo and pipe can be listened on; see Open.
+func OpenListener(ctx context.Context, rawURL string, opts ...ListenOption) (net.Listener, error) {
+	u, s, err := lookupScheme(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.Listen(ctx, u, opts...)
+}
+
+// urlPath returns the path that u points to, which may be relative if its
+// first element ended up as the host.
+func urlPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+func dialExecURL(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error) {
+	q := u.Query()
+	cmd := exec.Command(urlPath(u), q["arg"]...)
+	if env := q["env"]; len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Dir = q.Get("dir")
+	return DialCommand(ctx, cmd, opts...)
+}
+
+// fifoPaths returns the FIFO to read from and the one to write to.
+func fifoPaths(u *url.URL) (string, string, error) {
+	r, w, ok := strings.Cut(urlPath(u), ",")
+	if !ok || r == "" || w == "" {
+		return "", "", fmt.Errorf("fifo URL needs two paths, got %q", u)
+	}
+	return r, w, nil
+}
+
+// openFIFOs opens both FIFOs at once. Opening a FIFO blocks until the peer
+// opens its other end, so opening one after the other would deadlock with
+// a peer doing the same.
+func openFIFOs(ctx context.Context, u *url.URL) (*splitReadWriter, error) {
+	rPath, wPath, err := fifoPaths(u)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		f   *os.File
+		err error
+	}
+	rCh, wCh := make(chan result, 1), make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(rPath, os.O_RDONLY, 0)
+		rCh <- result{f, err}
+	}()
+	go func() {
+		f, err := os.OpenFile(wPath, os.O_WRONLY, 0)
+		wCh <- result{f, err}
+	}()
+
+	var r, w result
+	for n := 0; n < 2; n++ {
+		select {
+		case r = <-rCh:
+		case w = <-wCh:
+		case <-ctx.Done():
+			// Close whatever gets opened later.
+			go func(n int) {
+				for ; n < 2; n++ {
+					select {
+					case r := <-rCh:
+						closeFiles([]*os.File{r.f})
+					case w := <-wCh:
+						closeFiles([]*os.File{w.f})
+					}
+				}
+			}(n)
+			closeFiles([]*os.File{r.f, w.f})
+			return nil, ErrContextCanceled
+		}
+	}
+	if r.err != nil || w.err != nil {
+		closeFiles([]*os.File{r.f, w.f})
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, w.err
+	}
+	return &splitReadWriter{r.f, w.f}, nil
+}
+
+// fifoConn is a conn over a pair of FIFOs. Closing it closes them.
+type fifoConn struct {
+	*conn
+	p    *splitReadWriter
+	once sync.Once
+}
+
+func (c *fifoConn) Close() error {
+	err := c.conn.Close()
+	c.once.Do(func() { closeFIFOs(c.p) })
+	return err
+}
+
+func closeFIFOs(p *splitReadWriter) {
+	closeFiles([]*os.File{p.Reader.(*os.File), p.Writer.(*os.File)})
+}
+
+func dialFIFOURL(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error) {
+	p, err := openFIFOs(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial(ctx, p, opts...)
+	if err != nil {
+		closeFIFOs(p)
+		return nil, err
+	}
+	return &fifoConn{conn: c, p: p}, nil
+}
+
+func listenFIFOURL(ctx context.Context, u *url.URL, opts ...ListenOption) (net.Listener, error) {
+	p, err := openFIFOs(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	l := listen(ctx, p, opts...)
+	l.atClose(func() { closeFIFOs(p) })
+	return l, nil
+}
+
+func dialPipeURL(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error) {
+	d := Dialer{Options: opts}
+	return d.DialContext(ctx, "io", urlPath(u))
+}
+
+func listenPipeURL(ctx context.Context, u *url.URL, opts ...ListenOption) (net.Listener, error) {
+	return ListenName(ctx, urlPath(u), opts...)
+}
@@ -0,0 +1,136 @@
+package stdl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEcho writes to c and checks that the data comes back.
+func testEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	data := []byte("hello url\n")
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+func TestOpenExec(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	u := url.URL{Scheme: "exec", Path: os.Args[0], RawQuery: url.Values{
+		"arg": {"-test.run=^TestHelperProcess$"},
+		"env": {"STDL_HELPER=echo"},
+	}.Encode()}
+	c, err := Open(ctx, u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+}
+
+func TestOpenFIFO(t *testing.T) {
+	if _, err := exec.LookPath("mkfifo"); err != nil {
+		t.Skip("mkfifo is not available")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if out, err := exec.Command("mkfifo", a, b).CombinedOutput(); err != nil {
+		t.Fatalf("mkfifo: %s: %s", err, out)
+	}
+
+	listened := make(chan net.Listener, 1)
+	go func() {
+		l, err := OpenListener(ctx, "fifo://"+a+","+b)
+		if err != nil {
+			t.Error(err)
+			close(listened)
+			return
+		}
+		listened <- l
+		echo(l)
+	}()
+	c, err := Open(ctx, "fifo://"+b+","+a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	l, ok := <-listened
+	if !ok {
+		t.FailNow()
+	}
+	defer l.Close()
+	testEcho(t, c)
+}
+
+func TestOpenPipe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	l, err := OpenListener(ctx, "pipe://url-echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echo(l)
+
+	c, err := Open(ctx, "pipe://url-echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+	if got := c.RemoteAddr().(Addr).Name; got != "url-echo" {
+		t.Errorf("expected remote name %q, got %q", "url-echo", got)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := Open(ctx, "nope://x"); !errors.Is(err, ErrUnknownScheme) {
+		t.Errorf("expected ErrUnknownScheme, got %v", err)
+	}
+	if _, err := OpenListener(ctx, "exec:///bin/true"); err == nil {
+		t.Error("expected an error listening on an exec URL")
+	}
+	if _, err := Open(ctx, "fifo:///only-one"); err == nil {
+		t.Error("expected an error for a fifo URL with one path")
+	}
+}
+
+func TestRegisterScheme(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// A scheme that connects to a fresh echo listener for every dial.
+	RegisterScheme("echo", SchemeFuncs{DialFunc: func(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error) {
+		a, b := PipePair()
+		go echo(Listen(ctx, b))
+		return Dial(ctx, a, opts...)
+	}})
+	c, err := Open(ctx, "echo:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+}
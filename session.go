@@ -0,0 +1,649 @@
+package stdl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readBufferSize is the default size of the buffer used when reading
+// frames from the underlying io.ReadWriter.
+const readBufferSize = 65536
+
+// acceptBacklog is the default number of streams opened by the peer that
+// may wait for Accept before further streams are refused.
+const acceptBacklog = 16
+
+// sessions holds the session of every io.ReadWriter that is currently used
+// by Dial or Listen, so that several streams can share a single transport.
+var sessions = struct {
+	sync.Mutex
+	m map[io.ReadWriter]*session
+}{m: make(map[io.ReadWriter]*session)}
+
+// sessionConfig configures a new session.
+type sessionConfig struct {
+	readBufferSize int
+	eventLogger    *slog.Logger
+	handshake      bool
+
+	keepaliveInterval time.Duration
+	keepaliveMisses   int
+	onDisconnect      func(error)
+
+	checksums      bool
+	checksumPolicy ChecksumPolicy
+
+	reliable          bool
+	retransmitTimeout time.Duration
+	resumable         bool
+}
+
+// defaultSessionConfig is used for the sessions that Dial starts.
+func defaultSessionConfig() sessionConfig {
+	return sessionConfig{readBufferSize: readBufferSize, eventLogger: defaultLogger}
+}
+
+// sessionFor returns the session running on p, starting a new one with cfg
+// if there is none yet. The side that starts the session with Dial uses odd
+// stream IDs, the side that starts it with Listen uses even ones.
+func sessionFor(p io.ReadWriter, client bool, cfg sessionConfig) *session {
+	if !reflect.TypeOf(p).Comparable() {
+		s := newSession(p, client, cfg)
+		s.start()
+		return s
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if s, ok := sessions.m[p]; ok {
+		return s
+	}
+	s := newSession(p, client, cfg)
+	s.shared = true
+	sessions.m[p] = s
+	s.start()
+	return s
+}
+
+// session multiplexes any number of streams over a single io.ReadWriter.
+// p and r only change when a resumable session is resumed, and are then
+// guarded by mu.
+type session struct {
+	p          io.ReadWriter
+	r          *bufio.Reader
+	bufferSize int
+	shared     bool
+
+	// The writer goroutine sends the frames in prelude first, then those
+	// in ctrl, then those in sendCh.
+	prelude []*frame
+	ctrl    *controlQueue
+	sendCh  chan *frame
+
+	mu       sync.Mutex
+	streams  map[uint32]*conn
+	nextID   uint32
+	client   bool
+	listener *listener
+	// closeWhenIdle is set once the listener that started the session is
+	// closed. The session then ends with its last stream.
+	closeWhenIdle bool
+	closing       bool
+
+	done chan struct{}
+	err  error
+	once sync.Once
+
+	// ready is closed once the handshake succeeded. It is nil if the
+	// session has no handshake. features are the features that both ends
+	// support.
+	ready    chan struct{}
+	features Features
+
+	// alive is set whenever a frame arrives, and cleared by the keepalive
+	// goroutine, which runs if keepaliveInterval is positive.
+	alive             atomic.Bool
+	keepaliveInterval time.Duration
+	keepaliveMisses   int
+	onDisconnect      func(error)
+
+	// checksums is set in checksum mode. sendSeq is the sequence number of
+	// the next record to write, recvSeq that of the next one to read.
+	checksums      bool
+	checksumPolicy ChecksumPolicy
+	sendSeq        uint32
+	recvSeq        uint32
+	// pending holds the records that arrived ahead of recvSeq in reliable
+	// mode.
+	pending map[uint32]receivedRecord
+
+	// In reliable mode, the reader stores the sequence number up to which
+	// the peer acknowledged records in peerAck, and the one up to which it
+	// received them in ackSeq, and notifies the writer.
+	reliable          bool
+	retransmitTimeout time.Duration
+	peerAck           atomic.Uint32
+	peerAcked         chan struct{}
+	ackSeq            atomic.Uint32
+	ackNeeded         chan struct{}
+
+	// lost is closed once the current transport failed or was replaced.
+	// A resumable session then waits for Resume, which hands the next
+	// transport to the writer over resumed. The reader holds recvMu while
+	// it takes a record, so that Resume knows how far it got. token
+	// authenticates Resume.
+	lost      chan struct{}
+	resumable bool
+	resumed   chan resumedTransport
+	resumeMu  sync.Mutex
+	recvMu    sync.Mutex
+	token     []byte
+
+	eventLogger *slog.Logger
+}
+
+// frame is an encoded frame queued for the writer goroutine. If done is
+// not nil, the result of writing the frame is sent on it. A raw frame is
+// written as is in checksum mode.
+type frame struct {
+	b    []byte
+	done chan error
+	raw  bool
+	// claimed is set by the writer goroutine when it takes the frame, or
+	// by write when it gives up on the frame, whichever comes first.
+	claimed atomic.Bool
+}
+
+// claim claims f, and reports whether nobody else did.
+func (f *frame) claim() bool {
+	return f.claimed.CompareAndSwap(false, true)
+}
+
+func newSession(p io.ReadWriter, client bool, cfg sessionConfig) *session {
+	s := new(session)
+	s.p = p
+	size := cfg.readBufferSize
+	if cfg.checksums && size < maxRecordSize {
+		// The reader peeks at whole records.
+		size = maxRecordSize
+	}
+	s.r = bufio.NewReaderSize(p, size)
+	s.bufferSize = size
+	s.lost = make(chan struct{})
+	s.ctrl = newControlQueue()
+	s.sendCh = make(chan *frame, acceptBacklog)
+	s.streams = make(map[uint32]*conn)
+	s.nextID = 2
+	s.client = client
+	if client {
+		s.nextID = 1
+	}
+	s.done = make(chan struct{})
+	s.eventLogger = cfg.eventLogger
+	s.keepaliveInterval = cfg.keepaliveInterval
+	s.keepaliveMisses = cfg.keepaliveMisses
+	s.onDisconnect = cfg.onDisconnect
+	s.checksums = cfg.checksums
+	s.checksumPolicy = cfg.checksumPolicy
+	if cfg.reliable {
+		s.reliable = true
+		s.retransmitTimeout = cfg.retransmitTimeout
+		s.peerAcked = make(chan struct{}, 1)
+		s.ackNeeded = make(chan struct{}, 1)
+	}
+	if cfg.handshake {
+		// The hello goes out before any frame.
+		s.ready = make(chan struct{})
+		s.prelude = append(s.prelude, &frame{b: appendHello(nil, s.localFeatures()), raw: true})
+	}
+	if cfg.resumable {
+		s.resumable = true
+		s.resumed = make(chan resumedTransport)
+		if client {
+			// The dialer makes up the token, and tells the listener.
+			s.token = newResumeToken()
+			s.prelude = append(s.prelude, &frame{b: appendFrame(nil, header{typ: frameToken}, s.token)})
+		}
+	}
+	return s
+}
+
+// start starts the goroutines that read and write the transport, and the
+// one that sends keepalive pings.
+func (s *session) start() {
+	go s.recv(s.r, s.lost)
+	if s.reliable {
+		go s.sendReliable(s.p, s.lost)
+	} else {
+		go s.send()
+	}
+	if s.keepaliveInterval > 0 {
+		go s.keepalive(s.keepaliveInterval, s.keepaliveMisses)
+	}
+}
+
+// open creates a new stream and announces it to the peer, once the
+// handshake is done.
+func (s *session) open(ctx context.Context) (*conn, error) {
+	if s.ready != nil {
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return nil, s.err
+		case <-ctx.Done():
+			return nil, ErrContextCanceled
+		}
+	}
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, s.err
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	c := newConn(ctx, s, id)
+	s.streams[id] = c
+	s.mu.Unlock()
+
+	if sent, err := s.write(ctx, nil, nil, header{typ: frameOpen, stream: id}, nil); err != nil {
+		if sent {
+			// The peer learns about the stream anyway.
+			s.control(header{typ: frameReset, stream: id})
+		}
+		s.remove(id)
+		return nil, err
+	}
+	return c, nil
+}
+
+// setListener makes streams opened by the peer available to l.
+func (s *session) setListener(l *listener) {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+}
+
+// remove forgets the stream id, which no longer counts as active.
+func (s *session) remove(id uint32) {
+	s.mu.Lock()
+	c := s.streams[id]
+	delete(s.streams, id)
+	idle := s.closeWhenIdle && len(s.streams) == 0
+	s.mu.Unlock()
+	if c != nil {
+		c.untrack()
+	}
+	if idle {
+		s.close()
+	}
+}
+
+// closeIfIdle ends a session started by Listen once it has no streams left.
+// Sessions started by Dial keep running, as more streams may be opened.
+func (s *session) closeIfIdle() {
+	s.mu.Lock()
+	if s.client || s.listener != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.closeWhenIdle = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.close()
+	}
+}
+
+// close ends the session. If the transport supports read deadlines, the
+// background reader is woken up so that it stops reading immediately.
+// Otherwise it stops after the next read from the transport returns.
+func (s *session) close() {
+	s.mu.Lock()
+	s.closing = true
+	p := s.p
+	s.mu.Unlock()
+	s.terminate(net.ErrClosed)
+	if d, ok := p.(readDeadliner); ok {
+		d.SetReadDeadline(time.Now())
+	}
+}
+
+// transport returns the io.ReadWriter that s currently runs over.
+func (s *session) transport() io.ReadWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.p
+}
+
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// write queues a frame and waits until it has been written to the
+// transport, ctx is done, or the deadline or closed channel is closed. Nil
+// channels are never closed. A frame that the writer goroutine has not
+// taken yet when write gives up is never sent. Once taken, it is sent
+// anyway, which sent reports.
+func (s *session) write(ctx context.Context, deadline, closed <-chan struct{}, h header, payload []byte) (sent bool, err error) {
+	f := &frame{b: appendFrame(nil, h, payload), done: make(chan error, 1)}
+	select {
+	case s.sendCh <- f:
+	case <-ctx.Done():
+		return false, ErrContextCanceled
+	case <-deadline:
+		return false, os.ErrDeadlineExceeded
+	case <-closed:
+		return false, net.ErrClosed
+	case <-s.done:
+		return false, s.err
+	}
+	select {
+	case err = <-f.done:
+		return err == nil, err
+	case <-ctx.Done():
+		err = ErrContextCanceled
+	case <-deadline:
+		err = os.ErrDeadlineExceeded
+	case <-closed:
+		err = net.ErrClosed
+	case <-s.done:
+		err = s.err
+	}
+	if f.claim() {
+		return false, err
+	}
+	// The frame may have been written in the meantime.
+	select {
+	case werr := <-f.done:
+		if werr == nil {
+			return true, nil
+		}
+		return false, werr
+	default:
+		return true, err
+	}
+}
+
+// control queues a control frame without waiting for it to be written. It
+// never blocks, as the reader goroutine uses it.
+func (s *session) control(h header) {
+	s.ctrl.add(h)
+}
+
+// send is the writer goroutine. Control frames go out before the frames
+// in sendCh, so that the peer can go on even if this end has lots to send.
+func (s *session) send() {
+	var buf []byte
+	write := func(f *frame) error {
+		if !f.claim() {
+			// Whoever queued the frame gave up on it.
+			return nil
+		}
+		b := f.b
+		if s.checksums && !f.raw {
+			buf = appendRecord(buf[:0], s.sendSeq, b)
+			b = buf
+			s.sendSeq++
+		}
+		_, err := s.p.Write(b)
+		if f.done != nil {
+			f.done <- err
+		}
+		if err != nil {
+			s.terminate(err)
+		}
+		return err
+	}
+	for _, f := range s.prelude {
+		if write(f) != nil {
+			return
+		}
+	}
+	for {
+		for _, f := range s.ctrl.take() {
+			if write(f) != nil {
+				return
+			}
+		}
+		select {
+		case <-s.ctrl.ready:
+		case f := <-s.sendCh:
+			if write(f) != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// recv is the reader goroutine of the transport that r reads, which is
+// lost once lost is closed.
+func (s *session) recv(r *bufio.Reader, lost chan struct{}) {
+	if s.ready != nil {
+		select {
+		case <-s.ready:
+			// The session was resumed.
+		default:
+			features, err := readHello(r, s.localFeatures())
+			if err != nil {
+				s.fail(lost, err)
+				return
+			}
+			s.features = features
+			close(s.ready)
+		}
+	}
+	if s.reliable {
+		s.recvReliable(r, lost)
+		return
+	}
+	hdr := make([]byte, headerSize)
+	for first := true; ; first = false {
+		h, payload, err := s.readFrame(r, hdr)
+		if err == ErrProtocol && first && isHello(hdr) {
+			err = &HandshakeError{Reason: "peer sent a hello, but the handshake is not enabled"}
+		}
+		var ce *ChecksumError
+		if errors.As(err, &ce) && s.checksumPolicy == ChecksumResync {
+			s.recover(ce)
+			continue
+		}
+		if err != nil {
+			s.fail(lost, err)
+			return
+		}
+		s.alive.Store(true)
+		select {
+		case <-s.done:
+			// The session was closed while the frame was on its way.
+			return
+		default:
+		}
+		s.handle(h, payload)
+	}
+}
+
+// readFrame reads the next frame from the transport, as a record in
+// checksum mode.
+func (s *session) readFrame(r *bufio.Reader, hdr []byte) (header, []byte, error) {
+	if s.checksums {
+		h, payload, _, err := s.readRecord(r)
+		return h, payload, err
+	}
+	return readFrame(r, hdr)
+}
+
+// localFeatures are the features announced in the hello.
+func (s *session) localFeatures() Features {
+	features := FeatureMux
+	if s.checksums {
+		features |= FeatureChecksums
+	}
+	if s.reliable {
+		features |= FeatureReliable
+	}
+	return features
+}
+
+// fail ends the session after reading from the transport failed with err.
+// A resumable session is suspended instead. lost tells the transport
+// that failed.
+func (s *session) fail(lost chan struct{}, err error) {
+	s.mu.Lock()
+	closing := s.closing
+	p := s.p
+	s.mu.Unlock()
+	if closing {
+		// Leave the transport usable for whoever reads from it next.
+		if d, ok := p.(readDeadliner); ok {
+			d.SetReadDeadline(time.Time{})
+		}
+		return
+	}
+	if isClosed(s.done) || isClosed(lost) {
+		// The session already ended, or moved on to another transport.
+		return
+	}
+	s.eventLogger.Error("failed to read", "err", err)
+	s.lose(lost, err)
+}
+
+// lose ends the session after its transport failed with err, or suspends
+// it until it is resumed if it is resumable.
+func (s *session) lose(lost chan struct{}, err error) {
+	if !s.resumable {
+		s.terminate(err)
+		return
+	}
+	if s.suspend(lost) {
+		s.eventLogger.Warn("transport lost, waiting for Resume", "err", err)
+		if s.onDisconnect != nil {
+			go s.onDisconnect(err)
+		}
+	}
+}
+
+func (s *session) handle(h header, payload []byte) {
+	switch h.typ {
+	case frameOpen:
+		s.accept(h.stream)
+	case frameData:
+		s.mu.Lock()
+		c, ok := s.streams[h.stream]
+		s.mu.Unlock()
+		if !ok {
+			s.eventLogger.Debug("dropped data for unknown stream", "stream", h.stream, "bytes", len(payload))
+			return
+		}
+		c.receive(payload)
+	case frameClose:
+		s.mu.Lock()
+		c, ok := s.streams[h.stream]
+		s.mu.Unlock()
+		if ok {
+			c.setRemoteClosed()
+		}
+	case frameWindow:
+		s.mu.Lock()
+		c, ok := s.streams[h.stream]
+		s.mu.Unlock()
+		if ok {
+			c.addCredit(int(binary.BigEndian.Uint32(payload)))
+		}
+	case framePing:
+		s.control(header{typ: framePong})
+	case framePong:
+		// Any frame shows that the peer is alive.
+	case frameToken:
+		s.mu.Lock()
+		if s.resumable && s.token == nil {
+			s.token = append([]byte(nil), payload...)
+		}
+		s.mu.Unlock()
+	case frameReset:
+		s.mu.Lock()
+		c, ok := s.streams[h.stream]
+		s.mu.Unlock()
+		if ok {
+			s.remove(h.stream)
+			c.setReset(ErrConnReset)
+		}
+	}
+}
+
+// accept registers a stream opened by the peer and hands it to the
+// listener, or refuses it if nobody is listening.
+func (s *session) accept(id uint32) {
+	s.mu.Lock()
+	l := s.listener
+	_, exists := s.streams[id]
+	if l == nil || exists {
+		s.mu.Unlock()
+		s.eventLogger.Info("refused stream", "stream", id)
+		s.control(header{typ: frameReset, stream: id})
+		return
+	}
+	c, err := l.newConn(s, id)
+	if err != nil {
+		s.mu.Unlock()
+		s.eventLogger.Warn("refused stream", "stream", id, "err", err)
+		l.refused.Add(1)
+		s.control(header{typ: frameReset, stream: id})
+		return
+	}
+	s.streams[id] = c
+	s.mu.Unlock()
+	c.announceWindow()
+
+	select {
+	case l.incoming <- c:
+		s.eventLogger.Debug("accepted stream", "stream", id)
+	default:
+		s.eventLogger.Warn("accept backlog full, refused stream", "stream", id)
+		l.refused.Add(1)
+		c.abort()
+	}
+}
+
+// terminate shuts the session down. Pending and future operations on its
+// streams fail with err. Unless the session was closed locally, the
+// disconnect function is called.
+func (s *session) terminate(err error) {
+	s.once.Do(func() {
+		s.err = err
+		s.mu.Lock()
+		for _, c := range s.streams {
+			c.untrack()
+		}
+		s.mu.Unlock()
+		close(s.done)
+
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if s.onDisconnect != nil && !closing {
+			go s.onDisconnect(err)
+		}
+
+		if s.shared {
+			p := s.transport()
+			sessions.Lock()
+			if sessions.m[p] == s {
+				delete(sessions.m, p)
+			}
+			sessions.Unlock()
+		}
+	})
+}
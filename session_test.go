@@ -0,0 +1,125 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echo accepts connections on l and writes back everything it reads.
+func echo(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			io.Copy(c, c)
+		}(c)
+	}
+}
+
+// testMultiplex opens several streams over q concurrently and checks that
+// each of them only sees its own data echoed back.
+func testMultiplex(t *testing.T, p, q io.ReadWriter) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	go echo(Listen(ctx, p))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := Dial(ctx, q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+
+			data := bytes.Repeat([]byte(fmt.Sprintf("stream %d;", i)), 4096)
+			wrote := make(chan error, 1)
+			go func() {
+				_, err := c.Write(data)
+				wrote <- err
+			}()
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Errorf("stream %d: %s", i, err)
+				return
+			}
+			if err := <-wrote; err != nil {
+				t.Errorf("stream %d: %s", i, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("stream %d: received data of another stream", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMultiplex(t *testing.T) {
+	p, q := PipePair()
+	testMultiplex(t, p, q)
+}
+
+func TestMultiplexFile(t *testing.T) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, f := range []*os.File{r1, w1, r2, w2} {
+			f.Close()
+		}
+	}()
+	testMultiplex(t, &splitReadWriter{r1, w2}, &splitReadWriter{r2, w1})
+}
+
+func TestRefused(t *testing.T) {
+	p, q := PipePair()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// Nobody listens on p, so the stream is refused.
+	sessionFor(p, false, defaultSessionConfig())
+	c, err := Dial(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrConnReset {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, _ := connPair(t, ctx)
+
+	// A second stream over the same transport, opened from the first one.
+	o, err := c.(Opener).Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.(*conn).s != c.(*conn).s {
+		t.Fatal("opened stream uses another session")
+	}
+	if o.(*conn).id == c.(*conn).id {
+		t.Fatal("opened stream reuses the stream ID")
+	}
+}
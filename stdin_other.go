@@ -0,0 +1,10 @@
+//go:build !wasip1
+
+package stdl
+
+import "os"
+
+// stdin returns the process's stdin for ListenStdio.
+func stdin() *os.File {
+	return os.Stdin
+}
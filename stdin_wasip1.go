@@ -0,0 +1,20 @@
+//go:build wasip1
+
+package stdl
+
+import (
+	"os"
+	"syscall"
+)
+
+// stdin returns the process's stdin for ListenStdio. A wasip1 module runs
+// on a single thread, so a blocking read of stdin would stall every other
+// goroutine, including the one writing to stdout. Switching stdin to
+// non-blocking mode lets the runtime poll it instead. Hosts that cannot do
+// that get os.Stdin as it is.
+func stdin() *os.File {
+	if err := syscall.SetNonblock(syscall.Stdin, true); err != nil {
+		return os.Stdin
+	}
+	return os.NewFile(uintptr(syscall.Stdin), "/dev/stdin")
+}
@@ -0,0 +1,110 @@
+package stdl
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// splitReadWriter joins a separate io.Reader and io.Writer into an
+// io.ReadWriter.
+type splitReadWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// SetReadDeadline forwards to the reader if it supports deadlines, so that
+// closing a listener can stop its background reader.
+func (p *splitReadWriter) SetReadDeadline(t time.Time) error {
+	if d, ok := p.Reader.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// ListenSplit is like Listen, but reads from r and writes to w.
+func ListenSplit(ctx context.Context, r io.Reader, w io.Writer, opts ...ListenOption) net.Listener {
+	return listen(ctx, &splitReadWriter{r, w}, opts...)
+}
+
+// ListenStdio serves a Listener on the process's stdin and stdout, which is
+// what the child side of DialCommand does.
+//
+// Anything else writing to stdout would corrupt the stream, so os.Stdout is
+// replaced with a pipe for as long as the listener is open. Whatever is
+// written to it, for example by an accidental fmt.Println, is logged as an
+// event and copied to os.Stderr, or to the writer given with
+// WithStdoutRedirect. Likewise, os.Stdin is replaced with an empty reader.
+// Both are restored by Close. If the platform has no pipes, os.Stdout and
+// os.Stdin are left alone.
+func ListenStdio(ctx context.Context, opts ...ListenOption) net.Listener {
+	l := listen(ctx, &splitReadWriter{stdin(), os.Stdout}, opts...)
+
+	restore, err := redirectStdio(l)
+	if err != nil {
+		l.eventLogger.Error("failed to redirect stdio", "err", err)
+		return l
+	}
+	l.atClose(restore)
+	return l
+}
+
+// WithStdoutRedirect sets where ListenStdio copies data written to
+// os.Stdout. A nil writer discards it.
+func WithStdoutRedirect(w io.Writer) ListenOption {
+	return listenOptionStdoutRedirect{w}
+}
+
+type listenOptionStdoutRedirect struct {
+	w io.Writer
+}
+
+func (opt listenOptionStdoutRedirect) applyListener(l *listener) {
+	l.stdoutRedirect = opt.w
+	if l.stdoutRedirect == nil {
+		l.stdoutRedirect = io.Discard
+	}
+}
+
+// redirectStdio replaces os.Stdin and os.Stdout with pipes on behalf of l.
+// The returned function puts the original files back.
+func redirectStdio(l *listener) (func(), error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		closeFiles([]*os.File{inR, inW})
+		return nil, err
+	}
+	inW.Close()
+
+	dst := l.stdoutRedirect
+	if dst == nil {
+		dst = os.Stderr
+	}
+	go func() {
+		defer outR.Close()
+		buf := make([]byte, 4096)
+		for {
+			n, err := outR.Read(buf)
+			if n > 0 {
+				l.eventLogger.Warn("redirected data written to stdout", "bytes", n)
+				dst.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inR, outW
+	return func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		closeFiles([]*os.File{inR, outW})
+	}, nil
+}
@@ -0,0 +1,55 @@
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListenSplit(t *testing.T) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFiles([]*os.File{r1, w1, r2, w2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	l := ListenSplit(ctx, r1, w2)
+	defer l.Close()
+	go echo(l)
+
+	c, err := Dial(ctx, &splitReadWriter{r2, w1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("split")
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+func TestListenStdioRestore(t *testing.T) {
+	stdin, stdout := os.Stdin, os.Stdout
+	var redirected bytes.Buffer
+	l := ListenStdio(context.Background(), WithStdoutRedirect(&redirected))
+	if os.Stdout == stdout || os.Stdin == stdin {
+		t.Fatal("stdio was not redirected")
+	}
+	l.Close()
+	if os.Stdout != stdout || os.Stdin != stdin {
+		t.Fatal("stdio was not restored")
+	}
+}
@@ -12,7 +12,7 @@ import (
 )
 
 func TestSimple(t *testing.T) {
-	p := Pipe()
+	p, q := PipePair()
 	pass := make(chan error)
 	data := []byte("hello")
 
@@ -20,14 +20,20 @@ func TestSimple(t *testing.T) {
 	defer cancel()
 	SetLogger(log.New(os.Stdout, "[Listener] ", log.Lmicroseconds|log.Lshortfile))
 	il := Listen(ctx, p)
+	served := make(chan struct{})
+	defer func() {
+		il.Close()
+		<-served
+	}()
 
 	// Server
 	go func(ctx context.Context, l net.Listener) {
+		defer close(served)
 		for {
 			c, err := l.Accept()
 			if err != nil {
 				t.Logf("failed to accept: %s", err)
-				continue
+				return
 			}
 			if c == nil {
 				continue
@@ -53,7 +59,7 @@ func TestSimple(t *testing.T) {
 
 	// Client
 	c, err := Dial(
-		ctx, p,
+		ctx, q,
 		WithErrorLogger(log.New(os.Stdout, "[Client Error] ", log.Lmicroseconds|log.Lshortfile)),
 		WithEventLogger(log.New(os.Stdout, "[Client Event] ", log.Lmicroseconds|log.Lshortfile)),
 	)
@@ -82,3 +88,17 @@ func TestSimple(t *testing.T) {
 		}
 	}
 }
+
+// testContext returns a context that ends shortly before the test times
+// out, so that a test that hangs fails with its own error.
+func testContext(t *testing.T) context.Context {
+	deadline, ok := t.Deadline()
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return ctx
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(-5*time.Second))
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,41 @@
+// Command echo is a WASM guest for the tests. It serves a stdl Listener on
+// its stdio and echoes every line back. The line "exit N" makes it exit
+// with status N instead. TestMain builds it.
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aksial/stdl"
+)
+
+func main() {
+	l := stdl.ListenStdio(context.Background())
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go serve(c)
+	}
+}
+
+func serve(c net.Conn) {
+	defer c.Close()
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		line := s.Text()
+		if code, ok := strings.CutPrefix(line, "exit "); ok {
+			n, _ := strconv.Atoi(code)
+			fmt.Fprintf(os.Stderr, "exiting with status %d\n", n)
+			os.Exit(n)
+		}
+		fmt.Fprintln(c, line)
+	}
+}
@@ -0,0 +1,89 @@
+// Package server implements the Arithmetic service for the tests.
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aksial/stdl/testdata/grpc/arithmetic/arithmetic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DelayKey is the metadata key of a call that should be delayed by the given
+// number of milliseconds. The delay ends early if the call is canceled, which
+// is how the tests check that cancellation reaches the server.
+const DelayKey = "x-delay-ms"
+
+// New returns a gRPC server with the Arithmetic service registered.
+func New() *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(delay))
+	arithmetic.RegisterArithmeticServer(s, Server{})
+	return s
+}
+
+func delay(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(DelayKey); len(v) > 0 {
+		ms, err := strconv.Atoi(v[0])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "malformed %s: %q", DelayKey, v[0])
+		}
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	return handler(ctx, req)
+}
+
+// Server implements the Arithmetic service. Sub and Div apply the operation
+// to the first value and every following one in turn.
+type Server struct {
+	arithmetic.UnimplementedArithmeticServer
+}
+
+func (Server) Add(_ context.Context, in *arithmetic.Many) (*arithmetic.One, error) {
+	var v float64
+	for _, x := range in.Values {
+		v += x
+	}
+	return &arithmetic.One{Value: v}, nil
+}
+
+func (Server) Sub(_ context.Context, in *arithmetic.Many) (*arithmetic.One, error) {
+	if len(in.Values) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "nothing to subtract from")
+	}
+	v := in.Values[0]
+	for _, x := range in.Values[1:] {
+		v -= x
+	}
+	return &arithmetic.One{Value: v}, nil
+}
+
+func (Server) Mul(_ context.Context, in *arithmetic.Many) (*arithmetic.One, error) {
+	v := 1.0
+	for _, x := range in.Values {
+		v *= x
+	}
+	return &arithmetic.One{Value: v}, nil
+}
+
+func (Server) Div(_ context.Context, in *arithmetic.Many) (*arithmetic.One, error) {
+	if len(in.Values) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "nothing to divide")
+	}
+	v := in.Values[0]
+	for _, x := range in.Values[1:] {
+		if x == 0 {
+			return nil, status.Error(codes.InvalidArgument, "division by zero")
+		}
+		v /= x
+	}
+	return &arithmetic.One{Value: v}, nil
+}
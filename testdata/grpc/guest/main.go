@@ -0,0 +1,20 @@
+// Command guest serves the Arithmetic service on its stdio. It runs as a
+// WASM module in the tests, which TestMain builds.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aksial/stdl"
+	"github.com/aksial/stdl/testdata/grpc/arithmetic/server"
+)
+
+func main() {
+	ctx := context.Background()
+	if err := stdl.ServeGRPC(ctx, stdl.ListenStdio(ctx), server.New()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,302 @@
+//go:build !wasip1
+
+package stdl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// module is the transport to a running WASM module: it reads what the
+// module writes to its stdout and writes to its stdin.
+type module struct {
+	stdin  *os.File
+	stdout io.ReadCloser
+
+	exited chan struct{}
+	err    error
+}
+
+// Read reads from the module's stdout. Once the module has ended, a
+// non-zero exit code or a trap is returned instead of io.EOF or any other
+// read error.
+func (m *module) Read(b []byte) (int, error) {
+	n, err := m.stdout.Read(b)
+	if err == io.EOF {
+		<-m.exited
+	}
+	if err != nil && isClosed(m.exited) && m.err != nil {
+		err = m.err
+	}
+	return n, err
+}
+
+// Write writes to the module's stdin. If the module has ended, the reason
+// is returned instead of the write error.
+func (m *module) Write(b []byte) (int, error) {
+	n, err := m.stdin.Write(b)
+	if err != nil {
+		select {
+		case <-m.exited:
+			if m.err != nil {
+				err = m.err
+			}
+		case <-time.After(exitWait):
+		}
+	}
+	return n, err
+}
+
+// Close closes the host's ends of the module's stdin and stdout.
+func (m *module) Close() error {
+	m.stdin.Close()
+	return m.stdout.Close()
+}
+
+// moduleInstance is a running WASM module with a session over its stdio.
+type moduleInstance struct {
+	m           *module
+	s           *session
+	errorLogger *slog.Logger
+	cancel      context.CancelFunc
+	once        sync.Once
+}
+
+// stop closes the module's stdin and cancels its context. A module that
+// keeps running after its stdin is closed is only interrupted if the
+// runtime was configured with WithCloseOnContextDone, so stop waits for
+// the module no longer than exitWait.
+func (inst *moduleInstance) stop() {
+	inst.once.Do(func() {
+		inst.m.Close()
+		inst.cancel()
+		select {
+		case <-inst.m.exited:
+		case <-time.After(exitWait):
+		}
+	})
+}
+
+// moduleConn is a conn to a WASM module. Closing it stops the module.
+type moduleConn struct {
+	*conn
+	inst *moduleInstance
+}
+
+func (c *moduleConn) Close() error {
+	err := c.conn.Close()
+	c.inst.stop()
+	return err
+}
+
+// WithModuleConfig sets the configuration that DialWASM instantiates the
+// module with. Its stdin, stdout and stderr are replaced by DialWASM.
+func WithModuleConfig(cfg wazero.ModuleConfig) DialOption {
+	return dialOptionModuleConfig{cfg}
+}
+
+type dialOptionModuleConfig struct {
+	cfg wazero.ModuleConfig
+}
+
+func (dialOptionModuleConfig) apply(*conn) error {
+	return nil
+}
+
+// DialWASM compiles wasm and runs it with rt, and returns a net.Conn over
+// the module's stdin and stdout. The module is expected to serve a Listener
+// on its stdio, usually with ListenStdio. The runtime must have WASI
+// instantiated. Every line the module writes to stderr is sent to the error
+// logger of the conn.
+//
+// Closing the conn, or ctx being done, stops the module. If the module
+// exits with a non-zero code or traps, the next Read or Write on the conn
+// returns that error, for example a *sys.ExitError.
+//
+// The compiled module is closed once the module has ended, which also
+// drops it from an in-memory compilation cache of rt. To run a module
+// repeatedly without compiling it again, use a WASMPool, or create rt with
+// a cache in a directory.
+func DialWASM(ctx context.Context, rt wazero.Runtime, wasm []byte, opts ...DialOption) (net.Conn, error) {
+	compiled, err := rt.CompileModule(ctx, wasm)
+	if err != nil {
+		return nil, err
+	}
+	return dialModule(ctx, rt, compiled, true, opts...)
+}
+
+// dialModule runs compiled with rt, and opens a conn to it. If own is true,
+// compiled is closed once the module has ended, as nothing else runs it.
+func dialModule(ctx context.Context, rt wazero.Runtime, compiled wazero.CompiledModule, own bool, opts ...DialOption) (*moduleConn, error) {
+	inst, err := startModule(ctx, rt, compiled, own, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openConn(ctx, inst.s, opts...)
+	if err != nil {
+		inst.stop()
+		return nil, err
+	}
+	return &moduleConn{conn: c, inst: inst}, nil
+}
+
+// startModule runs compiled with rt like dialModule, and starts a session
+// over the module's stdio, but opens no stream. The module is stopped once
+// ctx is done.
+func startModule(ctx context.Context, rt wazero.Runtime, compiled wazero.CompiledModule, own bool, opts ...DialOption) (*moduleInstance, error) {
+	cfg := wazero.NewModuleConfig()
+	for _, opt := range opts {
+		if mc, ok := opt.(dialOptionModuleConfig); ok {
+			cfg = mc.cfg
+		}
+	}
+
+	// The module's stdin is an *os.File, which wazero can poll. That lets a
+	// module written in Go read it without blocking its other goroutines.
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		if own {
+			compiled.Close(ctx)
+		}
+		return nil, err
+	}
+	host, guest := PipePair()
+	stderr := new(lineLogger)
+	cfg = cfg.WithStdin(inR).WithStdout(guest).WithStderr(stderr)
+
+	m := &module{stdin: inW, stdout: host, exited: make(chan struct{})}
+	modCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		mod, err := rt.InstantiateModule(modCtx, compiled, cfg)
+		if mod != nil {
+			mod.Close(modCtx)
+		}
+		if exitErr, ok := err.(*sys.ExitError); ok && exitErr.ExitCode() == 0 {
+			err = nil
+		}
+		if own {
+			compiled.Close(context.Background())
+		}
+		m.err = err
+		close(m.exited)
+		inR.Close()
+		guest.Close()
+		stderr.Close()
+	}()
+
+	sc := defaultSessionConfig()
+	applySessionOptions(&sc, opts)
+	inst := &moduleInstance{m: m, s: sessionFor(m, true, sc), errorLogger: errorLoggerOf(opts), cancel: cancel}
+	stderr.setLogger(inst.errorLogger)
+	go func() {
+		select {
+		case <-ctx.Done():
+			inst.stop()
+		case <-m.exited:
+		}
+	}()
+	return inst, nil
+}
+
+// lineLogger is an io.Writer that prints every line written to it to a
+// logger. Lines written before the logger is known are held back.
+type lineLogger struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	buf    []byte
+	closed bool
+}
+
+func (w *lineLogger) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	w.flush(false)
+	return len(b), nil
+}
+
+func (w *lineLogger) setLogger(l *slog.Logger) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.logger = l
+	w.flush(w.closed)
+}
+
+// Close prints the last line, even if it is incomplete.
+func (w *lineLogger) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.flush(true)
+	return nil
+}
+
+func (w *lineLogger) flush(all bool) {
+	if w.logger == nil {
+		return
+	}
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Warn(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	if all && len(w.buf) > 0 {
+		w.logger.Warn(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func init() {
+	RegisterScheme("wasm", SchemeFuncs{DialFunc: dialWASMURL})
+}
+
+// dialWASMURL runs the module at the path of u in a runtime of its own,
+// which is closed once the module has ended.
+func dialWASMURL(ctx context.Context, u *url.URL, opts ...DialOption) (net.Conn, error) {
+	wasm, err := os.ReadFile(urlPath(u))
+	if err != nil {
+		return nil, err
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	compiled, err := rt.CompileModule(ctx, wasm)
+	if err == nil {
+		_, err = wasi_snapshot_preview1.Instantiate(ctx, rt)
+	}
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+
+	q := u.Query()
+	cfg := wazero.NewModuleConfig().WithArgs(append([]string{path.Base(urlPath(u))}, q["arg"]...)...)
+	for _, kv := range q["env"] {
+		k, v, _ := strings.Cut(kv, "=")
+		cfg = cfg.WithEnv(k, v)
+	}
+	mc, err := dialModule(ctx, rt, compiled, false, append([]DialOption{WithModuleConfig(cfg)}, opts...)...)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	go func() {
+		<-mc.inst.m.exited
+		rt.Close(context.Background())
+	}()
+	return mc, nil
+}
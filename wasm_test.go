@@ -1,13 +1,26 @@
+//go:build !wasip1
+
 package stdl
 
 import (
+	"bufio"
 	"context"
 	_ "embed"
 	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
 )
 
 //go:embed testdata/grpc/module/module.wasm
@@ -22,9 +35,9 @@ func TestWASM(t *testing.T) {
 	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
 
 	// Run the module's main (_start) function with custom stdin & stdout.
-	p := Pipe()
+	p, guest := PipePair()
 	go func() {
-		if _, err := rt.InstantiateWithConfig(ctx, moduleData, wazero.NewModuleConfig().WithStdin(p).WithStdout(p)); err != nil {
+		if _, err := rt.InstantiateWithConfig(ctx, moduleData, wazero.NewModuleConfig().WithStdin(guest).WithStdout(guest)); err != nil {
 			t.Log(err)
 		}
 	}()
@@ -37,7 +50,7 @@ func TestWASM(t *testing.T) {
 	}
 
 	// We've written to stdin. The module will write the doubled value back
-	// to its stdout, which is the pipe we created earlier.
+	// to its stdout, which is the other end of the pipe pair.
 	var d uint32
 	err = binary.Read(p, binary.LittleEndian, &d)
 	if err != nil {
@@ -48,3 +61,178 @@ func TestWASM(t *testing.T) {
 		t.Error("Input and output don't match")
 	}
 }
+
+// wasmCache is shared by the tests that run WASM modules, so that each
+// module is only compiled once. It keeps the compiled code in a directory,
+// as closing a compiled module drops it from an in-memory cache.
+var wasmCache wazero.CompilationCache
+
+// testModule is a WASM guest that TestMain builds from the Go package pkg,
+// and compiles into wasmCache, in the background, as that takes a while.
+// The guests embed this package, so they are built from the current tree
+// rather than kept in the repository.
+type testModule struct {
+	pkg  string
+	path string
+	wasm []byte
+	done chan struct{}
+	err  error
+}
+
+var (
+	echoModule       = &testModule{pkg: "./testdata/echo", done: make(chan struct{})}
+	arithmeticModule = &testModule{pkg: "./testdata/grpc/guest", done: make(chan struct{})}
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "stdl-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if wasmCache, err = wazero.NewCompilationCacheWithDir(filepath.Join(dir, "cache")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	if os.Getenv("STDL_HELPER") == "" {
+		go echoModule.build(dir)
+		if !testing.Short() {
+			go arithmeticModule.build(dir)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// build builds m into dir and compiles it.
+func (m *testModule) build(dir string) {
+	defer close(m.done)
+	m.path = filepath.Join(dir, filepath.Base(m.pkg)+".wasm")
+	cmd := exec.Command("go", "build", "-ldflags=-s -w", "-o", m.path, m.pkg)
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		m.err = fmt.Errorf("building %s: %v\n%s", m.pkg, err, out)
+		return
+	}
+	if m.wasm, m.err = os.ReadFile(m.path); m.err != nil {
+		return
+	}
+	if raceEnabled {
+		// The interpreter runs the modules, see newWASIRuntime.
+		return
+	}
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCompilationCache(wasmCache))
+	defer rt.Close(ctx)
+	_, m.err = rt.CompileModule(ctx, m.wasm)
+}
+
+// wait waits until m is built and compiled.
+func (m *testModule) wait(t *testing.T) {
+	t.Helper()
+	<-m.done
+	if m.err != nil {
+		t.Fatal(m.err)
+	}
+}
+
+// get returns the code of m.
+func (m *testModule) get(t *testing.T) []byte {
+	t.Helper()
+	m.wait(t)
+	return m.wasm
+}
+
+// file returns the path of the file that holds the code of m.
+func (m *testModule) file(t *testing.T) string {
+	t.Helper()
+	m.wait(t)
+	return m.path
+}
+
+// newWASIRuntime returns a runtime with WASI that uses wasmCache. With the
+// race detector, compiling the larger modules takes minutes, so the
+// interpreter runs them instead.
+func newWASIRuntime(t *testing.T, ctx context.Context) wazero.Runtime {
+	cfg := wazero.NewRuntimeConfig().WithCompilationCache(wasmCache)
+	if raceEnabled {
+		cfg = wazero.NewRuntimeConfigInterpreter()
+	}
+	cfg = cfg.WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, cfg)
+	t.Cleanup(func() { rt.Close(ctx) })
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	return rt
+}
+
+func TestDialWASM(t *testing.T) {
+	ctx := testContext(t)
+	rt := newWASIRuntime(t, ctx)
+
+	c, err := DialWASM(ctx, rt, echoModule.get(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Several streams are served concurrently by the same module.
+	for i := 0; i < 3; i++ {
+		o, err := c.(Opener).Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := fmt.Sprintf("hello %d\n", i)
+		if _, err := io.WriteString(o, line); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bufio.NewReader(o).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != line {
+			t.Fatalf("expected %q, got %q", line, got)
+		}
+		o.Close()
+	}
+}
+
+func TestDialWASMExit(t *testing.T) {
+	ctx := testContext(t)
+	rt := newWASIRuntime(t, ctx)
+
+	stderr := make(lineWriter, 16)
+	c, err := DialWASM(ctx, rt, echoModule.get(t), WithErrorLogger(log.New(stderr, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := io.WriteString(c, "exit 7\n"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Read(make([]byte, 1))
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 7 {
+		t.Fatalf("expected exit code 7, got %v", err)
+	}
+	for line := range stderr {
+		if line == "exiting with status 7\n" {
+			break
+		}
+	}
+}
+
+func TestOpenWASM(t *testing.T) {
+	// The scheme compiles the module in a runtime of its own.
+	ctx := testContext(t)
+
+	c, err := Open(ctx, (&url.URL{Scheme: "wasm", Path: echoModule.file(t)}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+}